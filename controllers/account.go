@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"Libraria/mail"
 	"Libraria/types"
 	"Libraria/utils"
 	"encoding/json"
@@ -29,7 +30,7 @@ func (s *LibServer) AccountSettingsHandler(w http.ResponseWriter, r *http.Reques
 	if r.Method != "POST" {
 		return utils.MethodNotAllowed(w)
 	}
-	acc, err := readJWT(r, s.store)
+	principal, err := accountPrincipal(r)
 	if err != nil {
 		return err
 	}
@@ -37,7 +38,7 @@ func (s *LibServer) AccountSettingsHandler(w http.ResponseWriter, r *http.Reques
 	if err := json.NewDecoder(r.Body).Decode(&newAcc); err != nil {
 		return err
 	}
-	newAcc.ID = acc.ID
+	newAcc.ID = principal.SubjectID
 	if err := newAcc.ValidateAccount(); err != nil {
 		return err
 	}
@@ -48,7 +49,6 @@ func (s *LibServer) AccountSettingsHandler(w http.ResponseWriter, r *http.Reques
 }
 
 func (s *LibServer) GetAccountHandler(w http.ResponseWriter, r *http.Request) error {
-	s.store.OneTimeClear()
 	if r.Method != "GET" {
 		return utils.MethodNotAllowed(w)
 	}
@@ -105,26 +105,31 @@ func (s *LibServer) AccountLoginHandler(w http.ResponseWriter, r *http.Request)
 		return err
 	}
 
-	acc, err := s.store.GetAccountByEmail(req.Email)
-	if err != nil {
+	email := normalizeEmail(req.Email)
+	if err := s.guardLogin(r, email); err != nil {
 		return err
 	}
-	if !acc.ValidPassword(req.Password) {
+	acc, err := s.store.GetAccountByEmail(req.Email)
+	if err != nil || !acc.ValidPassword(req.Password) {
+		if err := s.loginFailed(email); err != nil {
+			return err
+		}
 		return utils.NotAuthenticated(w)
 	}
-	token, err := createJWT(acc.Email)
-	if err != nil {
+	if err = s.store.ClearLoginFailures(email); err != nil {
 		return err
 	}
-	cookie := http.Cookie{
-		Name:     "x-jwt-token",
-		Value:    token,
-		HttpOnly: true,
-		Path:     "/",
-		Expires:  time.Now().Add(time.Minute * loginTimeMinutes),
+	// Stored hashes catch up with the configured algorithm and cost on the next login
+	if types.PasswordNeedsRehash(acc.Password) {
+		acc.Password = req.Password
+		if err = acc.PasswordHash(); err == nil {
+			err = s.store.UpdateAccountPassword(acc)
+		}
+		if err != nil {
+			fmt.Println("Error while rehashing password:", err)
+		}
 	}
-	http.SetCookie(w, &cookie)
-	return WriteJSON(w, http.StatusOK, cookie)
+	return s.completeLogin(w, types.NewAccountPrincipal(acc))
 	// redirect
 }
 
@@ -141,7 +146,6 @@ func (s *LibServer) AccountCreateHandler(w http.ResponseWriter, r *http.Request)
 		_, err = fmt.Fprintf(w, string(html))
 		return err
 	}
-	s.store.OneTimeClear()
 	var account types.Account
 
 	if err := json.NewDecoder(r.Body).Decode(&account); err != nil {
@@ -170,13 +174,13 @@ func (s *LibServer) AccountCreateHandler(w http.ResponseWriter, r *http.Request)
 		ExpiresAt: expiresAt,
 	}
 	fmt.Println(req)
-	err = s.store.CreateUserRequest(&req)
+	appeal := req.FirstName + " " + req.LastName
+	message, err := s.email.EmailConfirmation(req.Email, s.recipientLocale(r, "", 0), appeal, domain+"/account/confirm/"+req.Tag, req.ExpiresAt)
 	if err != nil {
 		return err
 	}
-	appeal := req.FirstName + " " + req.LastName
-	err = s.email.EmailConfirmationMessage(req.Email, appeal, domain+"/account/confirm/"+req.Tag)
-	fmt.Println(err)
+	// the message is queued with the request, a mail outage no longer leaves a request nobody heard of
+	err = s.store.CreateUserRequest(&req, mail.NewOutboxMessage(message, &req.ExpiresAt))
 	if err != nil {
 		return err
 	}
@@ -186,7 +190,6 @@ func (s *LibServer) AccountCreateHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *LibServer) AccountConfirm(w http.ResponseWriter, r *http.Request) error {
-	s.store.OneTimeClear()
 	if r.Method != "GET" {
 		return utils.MethodNotAllowed(w)
 	}
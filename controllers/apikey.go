@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"Libraria/types"
+	"Libraria/utils"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const apiKeyPrefix = "lk_"
+
+func (s *LibServer) APIKeysHandler(w http.ResponseWriter, r *http.Request) error {
+	principal, err := libraryPrincipal(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		keys, err := s.store.GetAPIKeysByLibraryID(int(principal.SubjectID))
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, keys)
+	}
+	if r.Method != "POST" {
+		return utils.MethodNotAllowed(w)
+	}
+	var key types.APIKey
+	if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+		return err
+	}
+	if err := key.ValidateAPIKey(); err != nil {
+		return err
+	}
+	secret, err := newToken(24)
+	if err != nil {
+		return err
+	}
+	token := apiKeyPrefix + secret
+	key.LibraryID = principal.SubjectID
+	key.Prefix = token[:len(apiKeyPrefix)+8]
+	key.Hash = hashToken(token)
+	key.CreatedAt = time.Now().UTC()
+	if err = s.store.CreateAPIKey(&key); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, types.NewAPIKey{APIKey: key, Key: token})
+}
+
+func (s *LibServer) APIKeyHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "DELETE" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := libraryPrincipal(r)
+	if err != nil {
+		return err
+	}
+	id, err := utils.GetID(r)
+	if err != nil {
+		return err
+	}
+	if err = s.store.RevokeAPIKey(id, int(principal.SubjectID)); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, "API key revoked")
+}
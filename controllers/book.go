@@ -18,12 +18,7 @@ func (s *LibServer) GetLibrariesByBookIDHandler(w http.ResponseWriter, r *http.R
 	if err != nil {
 		return err
 	}
-	var web_libs []types.LibraryWeb
-	for i := 0; i < len(*libs); i++ {
-		web := (*libs)[i].ConvertToWeb()
-		web_libs = append(web_libs, *web)
-	}
-	return WriteJSON(w, http.StatusOK, web_libs)
+	return WriteJSON(w, http.StatusOK, libs)
 }
 
 func (s *LibServer) GetBooksByLibraryIDHandler(w http.ResponseWriter, r *http.Request) error {
@@ -68,9 +63,9 @@ func (s *LibServer) BookHandler(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 	_, err = fmt.Fprintf(w, string(html))
-	if acc, err := readJWT(r, s.store); err == nil {
-		fmt.Println("Adding a book", acc)
-		s.store.AddBookVisit(int(acc.ID), id)
+	if principal, err := accountPrincipal(r); err == nil {
+		fmt.Println("Adding a book", principal)
+		s.store.AddBookVisit(int(principal.SubjectID), id)
 	}
 	return err
 }
@@ -3,8 +3,11 @@ package controllers
 import (
 	"Libraria/database"
 	"Libraria/mail"
+	"Libraria/oidc"
+	"Libraria/scheduler"
 	"Libraria/types"
 	"Libraria/utils"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +17,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -22,75 +28,160 @@ const (
 )
 
 var (
-	ErrorUnauthorized               = errors.New("unauthorized")
-	loginTimeMinutes  time.Duration = 120
+	ErrorUnauthorized = errors.New("unauthorized")
 	domain            string
 )
 
 type LibServer struct {
 	listenAddr string
 	store      database.Storage
-	email      mail.Email
+	email      mail.Mailer
+	limiter    utils.Limiter
+	oidc       *oidc.Provider
+	outbox     *mail.Outbox
+	jobs       *scheduler.Scheduler
+
+	reminderDays []int
+	overdueDays  []int
 }
 
 func MakeHTTPHandleFunc(f LibFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
+			var limitErr *utils.RateLimitError
+			if errors.As(err, &limitErr) {
+				utils.TooManyRequests(w, limitErr.RetryAfter)
+				return
+			}
 			WriteJSON(w, http.StatusBadRequest, LibError{Error: err.Error()})
 		}
 	}
 }
 
-func NewLibServer(listenAddr string, store database.Storage, email mail.Email) *LibServer {
-	return &LibServer{
+func NewLibServer(listenAddr string, store database.Storage, email mail.Mailer, provider *oidc.Provider) *LibServer {
+	s := &LibServer{
 		listenAddr: listenAddr,
 		store:      store,
 		email:      email,
+		limiter:    newLimiter(store),
+		oidc:       provider,
+		outbox:     mail.NewOutbox(store, email),
+		jobs:       scheduler.New(store),
 	}
+	s.registerJobs()
+	return s
 }
 
+// Run serves until SIGINT or SIGTERM, then lets in-flight requests and jobs finish before returning
 func (s *LibServer) Run() {
 	domain = os.Getenv("DOMAIN")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	jobsDone := make(chan struct{})
+	go func() {
+		s.jobs.Run(ctx)
+		close(jobsDone)
+	}()
 	r := mux.NewRouter()
+	r.Use(s.withSessionRefresh)
+	r.Use(s.withPrincipal)
 
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
 
 	r.HandleFunc("/", MakeHTTPHandleFunc(s.HomeHandler)) // get books & libs
 	r.HandleFunc("/about", MakeHTTPHandleFunc(s.AboutHandler))
 	r.HandleFunc("/search", MakeHTTPHandleFunc(s.SearchHandler)) // search & filter
-
-	r.HandleFunc("/account/settings", MakeHTTPHandleFunc(s.AccountSettingsHandler))
+	r.HandleFunc("/search/autocomplete", MakeHTTPHandleFunc(s.AutocompleteHandler))
+
+	r.HandleFunc("/account/settings", withRole(MakeHTTPHandleFunc(s.AccountSettingsHandler), types.RolePatron, types.RoleAdmin))
+	r.HandleFunc("/account/settings/email", withRole(MakeHTTPHandleFunc(s.EmailChangeHandler), types.RolePatron, types.RoleAdmin))
+	r.HandleFunc("/account/settings/password", withRole(MakeHTTPHandleFunc(s.PasswordChangeHandler), types.RolePatron, types.RoleAdmin))
+	r.HandleFunc("/account/settings/delete", withRole(MakeHTTPHandleFunc(s.AccountDeleteHandler), types.RolePatron, types.RoleAdmin))
+	r.HandleFunc("/account/settings/locale", withRole(MakeHTTPHandleFunc(s.LocaleHandler), types.RolePatron, types.RoleAdmin))
+	r.HandleFunc("/account/settings/2fa", withRole(MakeHTTPHandleFunc(s.TwoFactorHandler), types.RolePatron, types.RoleAdmin))
+	r.HandleFunc("/account/settings/2fa/verify", withRole(MakeHTTPHandleFunc(s.TwoFactorVerifyHandler), types.RolePatron, types.RoleAdmin))
 	r.HandleFunc("/account/confirm/{tag}", MakeHTTPHandleFunc(s.AccountConfirm))
 	r.HandleFunc("/account/register", MakeHTTPHandleFunc(s.AccountCreateHandler))
 	r.HandleFunc("/account/login", MakeHTTPHandleFunc(s.AccountLoginHandler))
-	r.HandleFunc("/account/{id}", withJWTAuth(MakeHTTPHandleFunc(s.AccountHandler), s.store))
+	r.HandleFunc("/account/export", MakeHTTPHandleFunc(s.AccountExportHandler))
+	r.HandleFunc("/account/delete/{tag}", MakeHTTPHandleFunc(s.AccountDeleteConfirmHandler))
+	r.HandleFunc("/account/oidc", MakeHTTPHandleFunc(s.OIDCLoginHandler))
+	r.HandleFunc("/account/oidc/callback", MakeHTTPHandleFunc(s.OIDCCallbackHandler))
+	r.HandleFunc("/account/{id}", withJWTAuth(MakeHTTPHandleFunc(s.AccountHandler)))
 
 	r.HandleFunc("/password_reset/{tag}", MakeHTTPHandleFunc(s.PasswordResetConfirmHandler))
 	r.HandleFunc("/password_reset", MakeHTTPHandleFunc(s.PasswordResetHandler))
-
-	r.HandleFunc("/library/settings", MakeHTTPHandleFunc(s.LibrarySettingsHandler))
+	r.HandleFunc("/email_change/{tag}", MakeHTTPHandleFunc(s.EmailChangeConfirmHandler))
+
+	r.HandleFunc("/library/settings", withRole(MakeHTTPHandleFunc(s.LibrarySettingsHandler), types.RoleLibrary))
+	r.HandleFunc("/library/settings/schedule", withRole(MakeHTTPHandleFunc(s.LibraryScheduleHandler), types.RoleLibrary))
+	r.HandleFunc("/library/settings/email", withRole(MakeHTTPHandleFunc(s.EmailChangeHandler), types.RoleLibrary))
+	r.HandleFunc("/library/settings/password", withRole(MakeHTTPHandleFunc(s.PasswordChangeHandler), types.RoleLibrary))
+	r.HandleFunc("/library/settings/locale", withRole(MakeHTTPHandleFunc(s.LocaleHandler), types.RoleLibrary))
+	r.HandleFunc("/library/settings/2fa", withRole(MakeHTTPHandleFunc(s.TwoFactorHandler), types.RoleLibrary))
+	r.HandleFunc("/library/settings/2fa/verify", withRole(MakeHTTPHandleFunc(s.TwoFactorVerifyHandler), types.RoleLibrary))
+	r.HandleFunc("/library/settings/apikeys", withRole(MakeHTTPHandleFunc(s.APIKeysHandler), types.RoleLibrary))
+	r.HandleFunc("/library/settings/apikeys/{id}", withRole(MakeHTTPHandleFunc(s.APIKeyHandler), types.RoleLibrary))
 	r.HandleFunc("/library/confirm/{tag}", MakeHTTPHandleFunc(s.LibraryConfirmHandler))
 	r.HandleFunc("/library/register", MakeHTTPHandleFunc(s.LibraryCreateHandler))
 	r.HandleFunc("/library/login", MakeHTTPHandleFunc(s.LibraryLoginHandler))
+	r.HandleFunc("/library/books", withScope(MakeHTTPHandleFunc(s.LibraryBooksHandler), types.ScopeInventoryWrite, types.RoleLibrary))
+	r.HandleFunc("/library/books/{id}", withScope(MakeHTTPHandleFunc(s.LibraryBookHandler), types.ScopeInventoryWrite, types.RoleLibrary))
+	r.HandleFunc("/library/items", withScope(MakeHTTPHandleFunc(s.ItemCreateHandler), types.ScopeInventoryWrite, types.RoleLibrary))
+	r.HandleFunc("/library/items/{barcode}", withScope(MakeHTTPHandleFunc(s.ItemHandler), types.ScopeInventoryWrite, types.RoleLibrary))
 	r.HandleFunc("/library/{id}", MakeHTTPHandleFunc(s.GetLibraryHandler))
 	r.HandleFunc("/library", MakeHTTPHandleFunc(s.LibraryHandler))
 
 	r.HandleFunc("/unAuthorize", MakeHTTPHandleFunc(s.UnAuthorizeHandler))
+	r.HandleFunc("/auth/refresh", MakeHTTPHandleFunc(s.RefreshHandler))
+	r.HandleFunc("/auth/2fa", MakeHTTPHandleFunc(s.TwoFactorLoginHandler))
+	r.HandleFunc("/auth/logoutAll", MakeHTTPHandleFunc(s.LogoutAllHandler))
 	r.HandleFunc("/getHeader", MakeHTTPHandleFunc(s.GetHeaderHandler))
 
-	r.HandleFunc("/book/{id}", MakeHTTPHandleFunc(s.BookHandler))
-	r.HandleFunc("/book/create", MakeHTTPHandleFunc(s.BookCreateHandler))
+	r.HandleFunc("/admin/jobs", withRole(MakeHTTPHandleFunc(s.JobsHandler), types.RoleAdmin))
+	r.HandleFunc("/admin/outbox", withRole(MakeHTTPHandleFunc(s.OutboxHandler), types.RoleAdmin))
+	r.HandleFunc("/admin/outbox/{id}/resend", withRole(MakeHTTPHandleFunc(s.OutboxResendHandler), types.RoleAdmin))
+
+	r.HandleFunc("/book/{id}", withRole(MakeHTTPHandleFunc(s.BookHandler), types.RoleAdmin))
+	r.HandleFunc("/book/create", withRole(MakeHTTPHandleFunc(s.BookCreateHandler), types.RoleAdmin))
+
+	r.HandleFunc("/loan/checkout", withRole(MakeHTTPHandleFunc(s.LoanCheckoutHandler), types.RoleLibrary))
+	r.HandleFunc("/loan/{id}/return", withRole(MakeHTTPHandleFunc(s.LoanReturnHandler), types.RoleLibrary))
+
+	r.HandleFunc("/hold", withRole(MakeHTTPHandleFunc(s.HoldCreateHandler), types.RolePatron, types.RoleAdmin))
+	r.HandleFunc("/hold/{id}", withRole(MakeHTTPHandleFunc(s.HoldHandler), types.RolePatron, types.RoleAdmin, types.RoleLibrary))
 
 	r.HandleFunc("/getAuth", MakeHTTPHandleFunc(s.GetAuthHandler))
 	r.HandleFunc("/getLibraries", MakeHTTPHandleFunc(s.GetAllLibrariesHandler))
 	r.HandleFunc("/getSomeBooks", MakeHTTPHandleFunc(s.GetSomeBooksHandler))
 	r.HandleFunc("/getLibrariesByBook/{id}", MakeHTTPHandleFunc(s.GetLibrariesByBookIDHandler))
+	r.HandleFunc("/getNearbyLibraries", MakeHTTPHandleFunc(s.GetNearbyLibrariesHandler))
+	r.HandleFunc("/getNearbyLibrariesByBook/{id}", MakeHTTPHandleFunc(s.GetNearbyLibrariesByBookHandler))
 	r.HandleFunc("/getLastBooks", MakeHTTPHandleFunc(s.GetLastBooks))
 	r.HandleFunc("/getBooksByLibrary/{id}", MakeHTTPHandleFunc(s.GetBooksByLibraryIDHandler))
-
-	if err := http.ListenAndServe(s.listenAddr, r); err != nil {
+	r.HandleFunc("/getMyLoans", MakeHTTPHandleFunc(s.GetMyLoansHandler))
+	r.HandleFunc("/getLibraryLoans", MakeHTTPHandleFunc(s.GetLibraryLoansHandler))
+	r.HandleFunc("/getMyHolds", MakeHTTPHandleFunc(s.GetMyHoldsHandler))
+	r.HandleFunc("/getLibraryHolds", MakeHTTPHandleFunc(s.GetLibraryHoldsHandler))
+
+	server := &http.Server{Addr: s.listenAddr, Handler: r}
+	// ListenAndServe returns as soon as Shutdown starts, serverDone tells when the draining is over
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			fmt.Println("Error while shutting down:", err)
+		}
+	}()
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
+	<-serverDone
+	<-jobsDone
 }
 
 func (s *LibServer) HomeHandler(w http.ResponseWriter, r *http.Request) error {
@@ -124,6 +215,7 @@ func (s *LibServer) AboutHandler(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (s *LibServer) UnAuthorizeHandler(w http.ResponseWriter, r *http.Request) error {
+	s.revokeSession(r)
 	deleteJWT(w)
 	_, err := fmt.Fprintf(w, "<script>window.location.href = '"+domain+"'; </script>")
 	return err
@@ -139,25 +231,31 @@ func (s *LibServer) GetHeaderHandler(w http.ResponseWriter, r *http.Request) err
 }
 
 func (s *LibServer) GetAuthHandler(w http.ResponseWriter, r *http.Request) error {
-	acc, err := readJWT(r, s.store)
-	lib, err2 := readLibJWT(r, s.store)
-	if err != nil && err2 != nil {
+	principal, err := getPrincipal(r)
+	if err != nil {
 		return err
 	}
 	w.Header().Add("Content-Type", "application/json")
-	if err == nil {
-		return json.NewEncoder(w).Encode(acc)
-	} else {
+	if principal.IsLibrary() {
+		lib, err := s.store.GetLibraryByID(int(principal.SubjectID))
+		if err != nil {
+			return ErrorUnauthorized
+		}
 		return json.NewEncoder(w).Encode(lib)
 	}
+	acc, err := s.store.GetAccountByID(int(principal.SubjectID))
+	if err != nil {
+		return ErrorUnauthorized
+	}
+	return json.NewEncoder(w).Encode(acc)
 }
 
 func (s *LibServer) GetLastBooks(w http.ResponseWriter, r *http.Request) error {
-	account, err := readJWT(r, s.store)
+	principal, err := accountPrincipal(r)
 	if err != nil {
 		return err
 	}
-	books, err := s.store.GetLastBooks(int(account.ID))
+	books, err := s.store.GetLastBooks(int(principal.SubjectID))
 	if err != nil {
 		return err
 	}
@@ -169,7 +267,15 @@ func (s *LibServer) GetAllLibrariesHandler(w http.ResponseWriter, r *http.Reques
 	if err != nil {
 		return err
 	}
-	return WriteJSON(w, http.StatusOK, libraries)
+	schedules, err := s.store.GetLibrarySchedules()
+	if err != nil {
+		return err
+	}
+	var libs []types.LibraryHours
+	for _, lib := range *libraries {
+		libs = append(libs, withHours(lib, schedules[lib.ID]))
+	}
+	return WriteJSON(w, http.StatusOK, libs)
 }
 
 func (s *LibServer) GetSomeBooksHandler(w http.ResponseWriter, r *http.Request) error {
@@ -195,98 +301,61 @@ func WriteJSON(w http.ResponseWriter, status int, v any) error {
 	return json.NewEncoder(w).Encode(v)
 }
 
-func withJWTAuth(handlerFunc http.HandlerFunc, s database.Storage) http.HandlerFunc {
+func withJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("calling JWT auth middleware")
-		tokenString, err := r.Cookie("x-jwt-token")
-		if err != nil {
-			utils.PermissionDenied(w)
-			return
-		}
-		token, err := validateJWT(tokenString.Value)
+		principal, err := accountPrincipal(r)
 		if err != nil {
 			utils.PermissionDenied(w)
 			return
 		}
-		if !token.Valid {
-			utils.PermissionDenied(w)
-			return
-		}
 		userID, err := utils.GetID(r)
-		if err != nil {
+		if err != nil || uint(userID) != principal.SubjectID {
 			utils.PermissionDenied(w)
 			return
 		}
-		account, err := s.GetAccountByID(userID)
-		if err != nil {
-			utils.PermissionDenied(w)
+
+		handlerFunc(w, r)
+	}
+}
+
+// withRole lets mutating requests through only for the given roles, GET requests serve pages and pass freely
+func withRole(handlerFunc http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return withScope(handlerFunc, "", roles...)
+}
+
+// withScope works like withRole and also admits API keys carrying the scope, other keys may only read
+func withScope(handlerFunc http.HandlerFunc, scope string, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			handlerFunc(w, r)
 			return
 		}
-
-		claims := token.Claims.(jwt.MapClaims)
-		if account.Email != claims["email"] {
+		principal, err := getPrincipal(r)
+		if err != nil || !principal.HasRole(roles...) {
 			utils.PermissionDenied(w)
 			return
 		}
-
-		if err != nil {
-			WriteJSON(w, http.StatusForbidden, LibError{Error: "invalid token"})
+		if principal.IsAPIKey() && (scope == "" || !principal.HasScope(scope)) {
+			utils.PermissionDenied(w)
 			return
 		}
-
 		handlerFunc(w, r)
 	}
 }
 
-func readJWT(r *http.Request, s database.Storage) (*types.Account, error) {
-	// Maybe rewriting in middleware format
-	tokenString, err := r.Cookie("x-jwt-token")
-	if err != nil {
-		return nil, ErrorUnauthorized
-	}
-	token, err := validateJWT(tokenString.Value)
-	if err != nil {
-		return nil, ErrorUnauthorized
-	}
-	if !token.Valid {
-		return nil, ErrorUnauthorized
-	}
-	claims := token.Claims.(jwt.MapClaims)
-	if claims["email"] == nil {
-		return nil, ErrorUnauthorized
-	}
-	account, err := s.GetAccountByEmail(claims["email"].(string))
-	if err != nil {
-		return nil, ErrorUnauthorized
-	}
-
-	return account, nil
-}
-
-func readLibJWT(r *http.Request, s database.Storage) (*types.LibraryAccount, error) {
-	tokenString, err := r.Cookie("x-jwt-token")
-	if err != nil {
-		return nil, ErrorUnauthorized
-	}
-	token, err := validateJWT(tokenString.Value)
-	if err != nil || !token.Valid {
-		return nil, ErrorUnauthorized
-	}
-	claims := token.Claims.(jwt.MapClaims)
-	if claims["email"] == nil {
-		return nil, ErrorUnauthorized
-	}
-	lib, err := s.GetLibraryByEmail(claims["email"].(string))
-	if err != nil {
-		return nil, ErrorUnauthorized
-	}
-	return lib, err
+type tokenClaims struct {
+	Kind      string   `json:"kind"`
+	Roles     []string `json:"roles"`
+	SessionID string   `json:"sid"`
+	jwt.RegisteredClaims
 }
 
-func validateJWT(tokenString string) (*jwt.Token, error) {
+func validateJWT(tokenString string) (*tokenClaims, error) {
 	secret := os.Getenv("JWT_SECRET")
 
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+	// Registered claims validation rejects tokens past their exp claim
+	var claims tokenClaims
+	token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
 		// Don't forget to validate the alg is what you expect:
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
@@ -295,25 +364,44 @@ func validateJWT(tokenString string) (*jwt.Token, error) {
 		// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
 		return []byte(secret), nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, ErrorUnauthorized
+	}
+	return &claims, nil
 }
 
-func createJWT(email string) (string, error) {
-	claims := &jwt.MapClaims{
-		"expiresAt": time.Now().Add(time.Minute * 5).Unix(),
-		"email":     email,
+func createJWT(principal *types.Principal) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(accessTokenTime)
+	claims := &tokenClaims{
+		Kind:      principal.Kind,
+		Roles:     principal.Roles,
+		SessionID: principal.SessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatUint(uint64(principal.SubjectID), 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
 	}
 
 	secret := os.Getenv("JWT_SECRET")
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
-	return token.SignedString([]byte(secret))
+	signed, err := token.SignedString([]byte(secret))
+	return signed, expiresAt, err
 }
 
 func deleteJWT(w http.ResponseWriter) {
-	cookie := http.Cookie{
-		Name:    "x-jwt-token",
-		Value:   "",
-		Expires: time.Now(),
+	for _, name := range []string{"x-jwt-token", "x-refresh-token"} {
+		cookie := http.Cookie{
+			Name:    name,
+			Value:   "",
+			Path:    "/",
+			Expires: time.Now(),
+		}
+		http.SetCookie(w, &cookie)
 	}
-	http.SetCookie(w, &cookie)
 }
@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"Libraria/types"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func requestAs(method string, principal *types.Principal) *http.Request {
+	r := httptest.NewRequest(method, "/library/books", nil)
+	if principal != nil {
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+	}
+	return r
+}
+
+func TestWithScope(t *testing.T) {
+	handler := withScope(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}, types.ScopeInventoryWrite, types.RoleLibrary)
+
+	readKey := types.NewAPIKeyPrincipal(&types.APIKey{ID: 1, LibraryID: 7, Scope: types.ScopeRead})
+	writeKey := types.NewAPIKeyPrincipal(&types.APIKey{ID: 2, LibraryID: 7, Scope: types.ScopeInventoryWrite})
+	library := types.NewLibraryPrincipal(&types.LibraryAccount{ID: 7})
+	patron := types.NewAccountPrincipal(&types.Account{ID: 3, Role: types.RolePatron})
+
+	tests := []struct {
+		name      string
+		method    string
+		principal *types.Principal
+		want      int
+	}{
+		{"read key may read", "GET", readKey, http.StatusOK},
+		{"read key may not write", "POST", readKey, http.StatusForbidden},
+		{"read key may not delete", "DELETE", readKey, http.StatusForbidden},
+		{"write key may write", "POST", writeKey, http.StatusOK},
+		{"write key may update", "PUT", writeKey, http.StatusOK},
+		{"library session may write", "POST", library, http.StatusOK},
+		{"patron may not write", "POST", patron, http.StatusForbidden},
+		{"anonymous may not write", "POST", nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler(w, requestAs(tt.method, tt.principal))
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestWithRoleRefusesAPIKeys(t *testing.T) {
+	handler := withRole(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}, types.RoleLibrary)
+	writeKey := types.NewAPIKeyPrincipal(&types.APIKey{ID: 2, LibraryID: 7, Scope: types.ScopeInventoryWrite})
+	w := httptest.NewRecorder()
+	handler(w, requestAs("POST", writeKey))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"Libraria/types"
+	"Libraria/utils"
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+)
+
+func (s *LibServer) GetNearbyLibrariesHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return utils.MethodNotAllowed(w)
+	}
+	lat, lng, radius, err := utils.GetCoordinates(r)
+	if err != nil {
+		return err
+	}
+	nearby := []types.NearbyLibrary{}
+	libs, err := s.store.GetLibraries()
+	if errors.Is(err, sql.ErrNoRows) {
+		return WriteJSON(w, http.StatusOK, nearby)
+	}
+	if err != nil {
+		return err
+	}
+	for _, lib := range *libs {
+		distance := utils.Haversine(lat, lng, float64(lib.Latitude), float64(lib.Longitude))
+		if distance <= radius {
+			nearby = append(nearby, types.NearbyLibrary{LibraryWeb: lib, Distance: roundKm(distance)})
+		}
+	}
+	sort.Slice(nearby, func(i, j int) bool { return nearby[i].Distance < nearby[j].Distance })
+	return WriteJSON(w, http.StatusOK, nearby)
+}
+
+func (s *LibServer) GetNearbyLibrariesByBookHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return utils.MethodNotAllowed(w)
+	}
+	id, err := utils.GetID(r)
+	if err != nil {
+		return err
+	}
+	lat, lng, radius, err := utils.GetCoordinates(r)
+	if err != nil {
+		return err
+	}
+	nearby := []types.NearbyHolding{}
+	libs, err := s.store.GetLibrariesByBookID(id)
+	if err != nil {
+		return WriteJSON(w, http.StatusOK, nearby)
+	}
+	for _, lib := range *libs {
+		if lib.Available == 0 {
+			continue
+		}
+		distance := utils.Haversine(lat, lng, float64(lib.Latitude), float64(lib.Longitude))
+		if distance <= radius {
+			nearby = append(nearby, types.NearbyHolding{LibraryHolding: lib, Distance: roundKm(distance)})
+		}
+	}
+	sort.Slice(nearby, func(i, j int) bool { return nearby[i].Distance < nearby[j].Distance })
+	return WriteJSON(w, http.StatusOK, nearby)
+}
+
+// roundKm keeps distances to meter precision in responses
+func roundKm(distance float64) float64 {
+	return math.Round(distance*1000) / 1000
+}
@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"Libraria/database"
+	"Libraria/mail"
+	"Libraria/types"
+	"Libraria/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const holdPickupDays = 3
+
+func (s *LibServer) HoldCreateHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := accountPrincipal(r)
+	if err != nil {
+		return err
+	}
+	var hold types.Hold
+	if err := json.NewDecoder(r.Body).Decode(&hold); err != nil {
+		return err
+	}
+	hold.UserID = principal.SubjectID
+	hold.CreatedAt = time.Now().UTC()
+	if err = s.store.PlaceHold(&hold); err != nil {
+		if errors.Is(err, database.ErrHoldExists) {
+			return WriteJSON(w, http.StatusConflict, LibError{Error: err.Error()})
+		}
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, hold)
+}
+
+func (s *LibServer) HoldHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "DELETE" {
+		return utils.MethodNotAllowed(w)
+	}
+	id, err := utils.GetID(r)
+	if err != nil {
+		return err
+	}
+	hold, err := s.store.GetHoldByID(id)
+	if err != nil {
+		return fmt.Errorf("hold not found")
+	}
+	// Patrons may cancel their own holds, libraries may drop any hold in their queue
+	principal, err := getPrincipal(r)
+	if err != nil {
+		return err
+	}
+	if !(principal.IsAccount() && principal.SubjectID == hold.UserID) && !(principal.IsLibrary() && principal.SubjectID == hold.LibraryID) {
+		return ErrorUnauthorized
+	}
+	hold, err = s.store.CancelHold(id)
+	if err != nil {
+		return err
+	}
+	if hold.Status == types.HoldReady {
+		s.serveHolds(hold.BookID, hold.LibraryID)
+	}
+	return WriteJSON(w, http.StatusOK, "Hold cancelled")
+}
+
+func (s *LibServer) GetMyHoldsHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := accountPrincipal(r)
+	if err != nil {
+		return err
+	}
+	holds, err := s.store.GetHoldsByUserID(int(principal.SubjectID))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, holds)
+}
+
+func (s *LibServer) GetLibraryHoldsHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := libraryPrincipal(r)
+	if err != nil {
+		return err
+	}
+	holds, err := s.store.GetHoldsByLibraryID(int(principal.SubjectID))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, holds)
+}
+
+// serveHolds hands copies on the shelf to waiting patrons and lets them know. It runs after a request
+// has already freed the copy, so failures are only logged and the hold_ready_alerts job retries the emails
+func (s *LibServer) serveHolds(bookID, libraryID uint) {
+	if err := s.handOverCopies(bookID, libraryID); err != nil {
+		fmt.Println("Error while serving holds:", err)
+	}
+}
+
+func (s *LibServer) handOverCopies(bookID, libraryID uint) error {
+	expiresAt := time.Now().UTC().AddDate(0, 0, holdPickupDays)
+	holds, err := s.store.ServeHolds(bookID, libraryID, expiresAt)
+	if err != nil {
+		return err
+	}
+	// the hold_ready_alerts job would pick these up as well, queueing now saves the patron a wait
+	var errs []error
+	for _, hold := range *holds {
+		hold := hold
+		err = s.notifyPatron(eventHoldReady, hold.ID, hold.UserID, hold.ExpiresAt, func(acc *types.Account, locale, appeal string) (*mail.Message, error) {
+			return s.email.HoldReady(acc.Email, locale, appeal, hold.BookName, hold.LibraryName, *hold.ExpiresAt)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("hold ready alert for hold %d: %w", hold.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// expireHolds rolls copies from missed pickups over to the next patron in the queue
+func (s *LibServer) expireHolds(ctx context.Context) error {
+	books, err := s.store.ExpireHolds()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, book := range *books {
+		if err = ctx.Err(); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		if err = s.handOverCopies(book.BookID, book.LibraryID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
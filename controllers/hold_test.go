@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"Libraria/database"
+	"Libraria/types"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// holdStore answers PlaceHold with a fixed error, any other storage call panics
+type holdStore struct {
+	database.Storage
+	err error
+}
+
+func (s *holdStore) PlaceHold(hold *types.Hold) error {
+	return s.err
+}
+
+func TestHoldCreateConflict(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"new hold", nil, http.StatusOK},
+		{"hold already placed", database.ErrHoldExists, http.StatusConflict},
+	}
+	patron := types.NewAccountPrincipal(&types.Account{ID: 5, Role: types.RolePatron})
+	for _, tt := range tests {
+		s := &LibServer{store: &holdStore{err: tt.err}}
+		w := httptest.NewRecorder()
+		if err := s.HoldCreateHandler(w, privacyRequest("POST", "/hold", `{"bookID":1,"libraryID":2}`, patron)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
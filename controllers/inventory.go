@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"Libraria/types"
+	"Libraria/utils"
+	"encoding/json"
+	"net/http"
+)
+
+func (s *LibServer) LibraryBooksHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := libraryPrincipal(r)
+	if err != nil {
+		return err
+	}
+	var book types.LibraryBook
+	if err := json.NewDecoder(r.Body).Decode(&book); err != nil {
+		return err
+	}
+	book.LibraryID = principal.SubjectID
+	if book.Amount == 0 {
+		book.Amount = 1
+	}
+	if err = s.store.AddLibraryBook(&book); err != nil {
+		return err
+	}
+	s.serveHolds(book.BookID, book.LibraryID)
+	return WriteJSON(w, http.StatusOK, book)
+}
+
+func (s *LibServer) LibraryBookHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "PUT" && r.Method != "DELETE" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := libraryPrincipal(r)
+	if err != nil {
+		return err
+	}
+	id, err := utils.GetID(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "DELETE" {
+		if err = s.store.DeleteLibraryBook(id, int(principal.SubjectID)); err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, "Book removed from library")
+	}
+	var book types.LibraryBook
+	if err := json.NewDecoder(r.Body).Decode(&book); err != nil {
+		return err
+	}
+	book.BookID = uint(id)
+	book.LibraryID = principal.SubjectID
+	if err = s.store.UpdateLibraryBook(&book); err != nil {
+		return err
+	}
+	s.serveHolds(book.BookID, book.LibraryID)
+	return WriteJSON(w, http.StatusOK, book)
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"Libraria/types"
+	"Libraria/utils"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+func (s *LibServer) ItemCreateHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := libraryPrincipal(r)
+	if err != nil {
+		return err
+	}
+	var item types.Item
+	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+		return err
+	}
+	item.LibraryID = principal.SubjectID
+	item.AddedAt = time.Now().UTC()
+	if item.Status == "" {
+		item.Status = types.ItemAvailable
+	}
+	if err = item.ValidateItem(); err != nil {
+		return err
+	}
+	if err = s.store.CreateItem(&item); err != nil {
+		return err
+	}
+	s.serveHolds(item.BookID, item.LibraryID)
+	return WriteJSON(w, http.StatusOK, item)
+}
+
+func (s *LibServer) ItemHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" && r.Method != "PUT" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := libraryPrincipal(r)
+	if err != nil {
+		return err
+	}
+	item, err := s.store.GetItemByBarcode(utils.GetBarcode(r))
+	if err != nil || item.LibraryID != principal.SubjectID {
+		return fmt.Errorf("copy not found")
+	}
+	if r.Method == "GET" {
+		return WriteJSON(w, http.StatusOK, item)
+	}
+	var update types.Item
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		return err
+	}
+	update.ID = item.ID
+	update.BookID = item.BookID
+	update.LibraryID = item.LibraryID
+	update.Barcode = item.Barcode
+	update.AddedAt = item.AddedAt
+	if err = update.ValidateItem(); err != nil {
+		return err
+	}
+	if err = s.store.UpdateItem(&update); err != nil {
+		return err
+	}
+	s.serveHolds(update.BookID, update.LibraryID)
+	return WriteJSON(w, http.StatusOK, update)
+}
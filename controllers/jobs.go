@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"Libraria/utils"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// registerJobs sets up everything the server does in the background
+func (s *LibServer) registerJobs() {
+	// a misconfigured list shows up as the error of every run until it is fixed
+	var reminderErr, overdueErr error
+	s.reminderDays, reminderErr = parseDays("REMINDER_DAYS", []int{3, 1})
+	s.overdueDays, overdueErr = parseDays("OVERDUE_DAYS", []int{1, 7, 14})
+
+	s.jobs.Add("cleanup", 5*time.Minute, s.store.ClearExpired)
+	s.jobs.Add("outbox", 10*time.Second, func(ctx context.Context) error {
+		s.outbox.Deliver()
+		return nil
+	})
+	s.jobs.Add("hold_expiry", time.Minute, s.expireHolds)
+	s.jobs.Add("due_reminders", time.Hour, func(ctx context.Context) error {
+		return errors.Join(reminderErr, s.sendDueReminders(ctx))
+	})
+	s.jobs.Add("overdue_notices", time.Hour, func(ctx context.Context) error {
+		return errors.Join(overdueErr, s.sendOverdueNotices(ctx))
+	})
+	s.jobs.Add("hold_ready_alerts", time.Minute, s.sendHoldReadyAlerts)
+}
+
+// JobsHandler shows admins how the background jobs are doing, the last run comes from
+// whichever instance held the lock while the counters are this instance's own
+func (s *LibServer) JobsHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return utils.MethodNotAllowed(w)
+	}
+	if _, err := adminPrincipal(r); err != nil {
+		return err
+	}
+	runs, err := s.store.GetJobRuns()
+	if err != nil {
+		return err
+	}
+	statuses := s.jobs.Status()
+	for i := range statuses {
+		for j := range *runs {
+			if (*runs)[j].Name == statuses[i].Name {
+				statuses[i].LastRun = &(*runs)[j]
+			}
+		}
+	}
+	return WriteJSON(w, http.StatusOK, statuses)
+}
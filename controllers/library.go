@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"Libraria/mail"
 	"Libraria/types"
 	"Libraria/utils"
 	"encoding/json"
@@ -35,7 +36,7 @@ func (s *LibServer) LibraryHandler(w http.ResponseWriter, r *http.Request) error
 
 func (s *LibServer) LibrarySettingsHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method == "GET" {
-		if _, err := readLibJWT(r, s.store); err != nil {
+		if _, err := libraryPrincipal(r); err != nil {
 			return err
 		}
 		html, err := os.ReadFile("static/librarySettings.html")
@@ -49,8 +50,8 @@ func (s *LibServer) LibrarySettingsHandler(w http.ResponseWriter, r *http.Reques
 		fmt.Println(r.URL, r.Method)
 		return utils.MethodNotAllowed(w)
 	}
-	lib, err := readLibJWT(r, s.store)
-	fmt.Println("READING LIB", lib, err)
+	principal, err := libraryPrincipal(r)
+	fmt.Println("READING LIB", principal, err)
 	if err != nil {
 		return err
 	}
@@ -62,7 +63,7 @@ func (s *LibServer) LibrarySettingsHandler(w http.ResponseWriter, r *http.Reques
 	if err := newLib.ValidateAccount(); err != nil {
 		return err
 	}
-	newLib.ID = lib.ID
+	newLib.ID = principal.SubjectID
 	fmt.Println("LIB", newLib)
 	if err := s.store.UpdateLibrary(&newLib); err != nil {
 		return err
@@ -83,7 +84,6 @@ func (s *LibServer) LibraryCreateHandler(w http.ResponseWriter, r *http.Request)
 		return err
 		// return HTML file
 	}
-	s.store.OneTimeClear()
 	var library types.LibraryAccount
 	if err := json.NewDecoder(r.Body).Decode(&library); err != nil {
 		return err
@@ -111,11 +111,12 @@ func (s *LibServer) LibraryCreateHandler(w http.ResponseWriter, r *http.Request)
 		Tag:           s.store.MakeToken("lib_requests"),
 		ExpiresAt:     expiresAt,
 	}
-	if err = s.store.CreateLibRequest(&req); err != nil {
+	appeal := req.Name + " Library"
+	message, err := s.email.EmailConfirmation(req.Email, s.recipientLocale(r, "", 0), appeal, domain+"/account/confirm/"+req.Tag, req.ExpiresAt)
+	if err != nil {
 		return err
 	}
-	appeal := req.Name + " Library"
-	if err = s.email.EmailConfirmationMessage(req.Email, appeal, domain+"/account/confirm/"+req.Tag); err != nil {
+	if err = s.store.CreateLibRequest(&req, mail.NewOutboxMessage(message, &req.ExpiresAt)); err != nil {
 		return err
 	}
 	ans := []any{fmt.Sprintf("Message was sent to %s , to confirm account please follow the instructions in the message", req.Email), req}
@@ -125,7 +126,6 @@ func (s *LibServer) LibraryCreateHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *LibServer) LibraryConfirmHandler(w http.ResponseWriter, r *http.Request) error {
-	s.store.OneTimeClear()
 	if r.Method != "GET" {
 		return utils.MethodNotAllowed(w)
 	}
@@ -179,7 +179,11 @@ func (s *LibServer) GetLibraryHandler(w http.ResponseWriter, r *http.Request) er
 	if err != nil {
 		return err
 	}
-	jsonLib := lib.ConvertToWeb()
+	schedule, err := s.store.GetLibrarySchedule(id)
+	if err != nil {
+		return err
+	}
+	jsonLib := withHours(*lib.ConvertToWeb(), schedule)
 	jsonMar, err := json.Marshal(jsonLib)
 	if err != nil {
 		return err
@@ -211,27 +215,29 @@ func (s *LibServer) LibraryLoginHandler(w http.ResponseWriter, r *http.Request)
 		return err
 	}
 
-	lib, err := s.store.GetLibraryByEmail(req.Email)
-	if err != nil {
+	email := normalizeEmail(req.Email)
+	if err := s.guardLogin(r, email); err != nil {
 		return err
 	}
-
-	if !lib.ValidPassword(req.Password) {
+	lib, err := s.store.GetLibraryByEmail(req.Email)
+	if err != nil || !lib.ValidPassword(req.Password) {
+		if err := s.loginFailed(email); err != nil {
+			return err
+		}
 		return fmt.Errorf("not authenticated")
 	}
-
-	token, err := createJWT(lib.Email)
-	if err != nil {
+	if err = s.store.ClearLoginFailures(email); err != nil {
 		return err
 	}
+	if types.PasswordNeedsRehash(lib.Password) {
+		lib.Password = req.Password
+		if err = lib.PasswordHash(); err == nil {
+			err = s.store.UpdateLibraryPassword(lib)
+		}
+		if err != nil {
+			fmt.Println("Error while rehashing password:", err)
+		}
+	}
 
-	cookie := http.Cookie{
-		Name:     "x-jwt-token",
-		Value:    token,
-		HttpOnly: true,
-		Path:     "/",
-		Expires:  time.Now().Add(time.Minute * loginTimeMinutes),
-	}
-	http.SetCookie(w, &cookie)
-	return WriteJSON(w, http.StatusOK, cookie)
+	return s.completeLogin(w, types.NewLibraryPrincipal(lib))
 }
@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"Libraria/types"
+	"Libraria/utils"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	loanDays    = 14
+	maxLoanDays = 60
+)
+
+func (s *LibServer) LoanCheckoutHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := libraryPrincipal(r)
+	if err != nil {
+		return err
+	}
+	var req types.CheckoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.Days == 0 {
+		req.Days = loanDays
+	}
+	if req.Days > maxLoanDays {
+		return fmt.Errorf("loan period can not exceed %d days", maxLoanDays)
+	}
+	acc, err := s.store.GetAccountByEmail(req.Email)
+	if err != nil {
+		return fmt.Errorf("account %s not found", req.Email)
+	}
+	var itemID uint
+	if req.Barcode != "" {
+		item, err := s.store.GetItemByBarcode(req.Barcode)
+		if err != nil || item.LibraryID != principal.SubjectID {
+			return fmt.Errorf("copy not found")
+		}
+		req.BookID = item.BookID
+		itemID = item.ID
+	}
+	schedule, err := s.store.GetLibrarySchedule(int(principal.SubjectID))
+	if err != nil {
+		return err
+	}
+	issuedAt := time.Now().UTC()
+	loan := types.Loan{
+		BookID:    req.BookID,
+		LibraryID: principal.SubjectID,
+		UserID:    acc.ID,
+		ItemID:    itemID,
+		IssuedAt:  issuedAt,
+		DueAt:     schedule.NextOpenDay(issuedAt.AddDate(0, 0, int(req.Days))).UTC(),
+	}
+	if err = s.store.CheckoutBook(&loan); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, loan)
+}
+
+func (s *LibServer) LoanReturnHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := libraryPrincipal(r)
+	if err != nil {
+		return err
+	}
+	id, err := utils.GetID(r)
+	if err != nil {
+		return err
+	}
+	loan, err := s.store.ReturnBook(id, int(principal.SubjectID))
+	if err != nil {
+		return err
+	}
+	s.serveHolds(loan.BookID, loan.LibraryID)
+	return WriteJSON(w, http.StatusOK, loan)
+}
+
+func (s *LibServer) GetMyLoansHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := accountPrincipal(r)
+	if err != nil {
+		return err
+	}
+	loans, err := s.store.GetLoansByUserID(int(principal.SubjectID))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, loans)
+}
+
+func (s *LibServer) GetLibraryLoansHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := libraryPrincipal(r)
+	if err != nil {
+		return err
+	}
+	loans, err := s.store.GetLoansByLibraryID(int(principal.SubjectID))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, loans)
+}
@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"Libraria/types"
+	"Libraria/utils"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// recipientLocale prefers the language saved in settings and falls back to the request's Accept-Language,
+// r is nil when the email is not triggered by the recipient
+func (s *LibServer) recipientLocale(r *http.Request, kind string, subjectID uint) string {
+	if subjectID != 0 {
+		if locale, err := s.store.GetLocale(kind, subjectID); err == nil && locale != "" {
+			return s.email.MatchLocale(locale)
+		}
+	}
+	if r == nil {
+		return s.email.MatchLocale("")
+	}
+	return s.email.MatchLocale(r.Header.Get("Accept-Language"))
+}
+
+// LocaleHandler reads and saves the language emails are sent in
+func (s *LibServer) LocaleHandler(w http.ResponseWriter, r *http.Request) error {
+	principal, err := getPrincipal(r)
+	if err != nil {
+		return err
+	}
+	kind := principal.SessionKind()
+
+	switch r.Method {
+	case "GET":
+		return WriteJSON(w, http.StatusOK, types.LocaleSettings{
+			Locale:  s.recipientLocale(r, kind, principal.SubjectID),
+			Locales: s.email.Locales(),
+		})
+	case "POST":
+		var settings types.LocaleSettings
+		if err = json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			return err
+		}
+		if !slices.Contains(s.email.Locales(), settings.Locale) {
+			return fmt.Errorf("unsupported language %s", settings.Locale)
+		}
+		if err = s.store.SetLocale(kind, principal.SubjectID, settings.Locale); err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, "Language saved")
+	}
+	return utils.MethodNotAllowed(w)
+}
@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"Libraria/types"
+	"Libraria/utils"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const oidcLoginTime = 10 * time.Minute
+
+// OIDCLoginHandler sends the browser to the identity provider with a fresh state, nonce and PKCE verifier
+func (s *LibServer) OIDCLoginHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return utils.MethodNotAllowed(w)
+	}
+	if s.oidc == nil {
+		return fmt.Errorf("single sign-on is not configured")
+	}
+	state, err := newToken(16)
+	if err != nil {
+		return err
+	}
+	nonce, err := newToken(16)
+	if err != nil {
+		return err
+	}
+	verifier, err := newToken(32)
+	if err != nil {
+		return err
+	}
+	login := &types.OIDCLogin{
+		State:     hashToken(state),
+		Verifier:  verifier,
+		Nonce:     nonce,
+		ExpiresAt: time.Now().UTC().Add(oidcLoginTime),
+	}
+	authURL, err := s.oidc.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		return err
+	}
+	if err = s.store.CreateOIDCLogin(login); err != nil {
+		return err
+	}
+	// The state is bound to this browser so that a callback can not be replayed from elsewhere
+	http.SetCookie(w, &http.Cookie{
+		Name:     "x-oidc-state",
+		Value:    state,
+		HttpOnly: true,
+		Path:     "/account/oidc",
+		SameSite: http.SameSiteLaxMode,
+		Expires:  login.ExpiresAt,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+	return nil
+}
+
+func (s *LibServer) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return utils.MethodNotAllowed(w)
+	}
+	if s.oidc == nil {
+		return fmt.Errorf("single sign-on is not configured")
+	}
+	query := r.URL.Query()
+	if query.Get("error") != "" {
+		return fmt.Errorf("sign-on failed: %s", query.Get("error"))
+	}
+	cookie, err := r.Cookie("x-oidc-state")
+	if err != nil || cookie.Value == "" || cookie.Value != query.Get("state") {
+		return fmt.Errorf("sign-on state mismatch")
+	}
+	http.SetCookie(w, &http.Cookie{Name: "x-oidc-state", Value: "", Path: "/account/oidc", Expires: time.Now()})
+	login, err := s.store.TakeOIDCLogin(hashToken(cookie.Value))
+	if err != nil {
+		return fmt.Errorf("sign-on attempt expired, please try again")
+	}
+
+	idToken, err := s.oidc.Exchange(query.Get("code"), login.Verifier)
+	if err != nil {
+		return err
+	}
+	claims, err := s.oidc.VerifyIDToken(idToken, login.Nonce)
+	if err != nil {
+		return err
+	}
+	acc, err := s.oidcAccount(claims.Issuer, claims.Subject, claims.Email, claims.EmailVerified, oidcNames(claims.GivenName, claims.FamilyName, claims.Name, claims.Email))
+	if err != nil {
+		return err
+	}
+
+	twoFactor, _, err := s.beginLogin(w, types.NewAccountPrincipal(acc))
+	if err != nil {
+		return err
+	}
+	if twoFactor {
+		http.Redirect(w, r, "/account/login?twoFactor=1", http.StatusFound)
+		return nil
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+// oidcAccount finds the account linked to the identity, otherwise links or creates one by verified email
+func (s *LibServer) oidcAccount(issuer, subject, email string, verified bool, names [2]string) (*types.Account, error) {
+	acc, err := s.store.GetAccountByIdentity(issuer, subject)
+	if err == nil {
+		return acc, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if email == "" || !verified {
+		return nil, fmt.Errorf("identity provider did not confirm the email address")
+	}
+
+	acc, err = s.store.GetAccountByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := s.store.GetLibraryByEmail(email); err == nil {
+			return nil, fmt.Errorf("email %s belongs to a library account", email)
+		}
+		// Accounts made through sign-on have no password until one is set with a reset
+		acc = &types.Account{FirstName: names[0], LastName: names[1], Email: email}
+		if err = s.store.CreateAccount(acc); err != nil {
+			return nil, err
+		}
+		acc, err = s.store.GetAccountByEmail(email)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = s.store.LinkIdentity(issuer, subject, acc.ID); err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+// oidcNames picks first and last name from the profile claims, falling back to the email
+func oidcNames(given, family, name, email string) [2]string {
+	if given == "" && family == "" {
+		parts := strings.Fields(name)
+		if len(parts) > 0 {
+			given = parts[0]
+			family = strings.Join(parts[1:], " ")
+		}
+	}
+	if given == "" {
+		given, _, _ = strings.Cut(email, "@")
+	}
+	if family == "" {
+		family = "-"
+	}
+	return [2]string{truncate(given, 15), truncate(family, 15)}
+}
+
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
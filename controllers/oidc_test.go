@@ -0,0 +1,348 @@
+package controllers
+
+import (
+	"Libraria/database"
+	"Libraria/oidc"
+	"Libraria/types"
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+const stubClientID = "libraria"
+
+// stubIdP is a minimal identity provider: discovery, JWKS, an authorization endpoint that
+// approves every request and a token endpoint that checks the PKCE verifier
+type stubIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	subject  string
+	email    string
+	verified bool
+	// nonce replaces the nonce from the authorization request in the ID token when set
+	nonce string
+
+	mu        sync.Mutex
+	grants    map[string]url.Values
+	exchanges int
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &stubIdP{key: key, subject: "user-1", email: "reader@example.com", verified: true, grants: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *stubIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != stubClientID {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	code := "code-" + query.Get("state")
+	idp.mu.Lock()
+	idp.grants[code] = query
+	idp.mu.Unlock()
+	back := url.Values{}
+	back.Set("code", code)
+	back.Set("state", query.Get("state"))
+	http.Redirect(w, r, query.Get("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+}
+
+func (idp *stubIdP) token(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.exchanges++
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	grant, ok := idp.grants[r.PostForm.Get("code")]
+	if !ok || oidc.Challenge(r.PostForm.Get("code_verifier")) != grant.Get("code_challenge") ||
+		r.PostForm.Get("redirect_uri") != grant.Get("redirect_uri") {
+		http.Error(w, "invalid_grant", http.StatusBadRequest)
+		return
+	}
+	delete(idp.grants, r.PostForm.Get("code"))
+	nonce := grant.Get("nonce")
+	if idp.nonce != "" {
+		nonce = idp.nonce
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &oidc.Claims{
+		Nonce:         nonce,
+		Email:         idp.email,
+		EmailVerified: idp.verified,
+		GivenName:     "Ada",
+		FamilyName:    "Reader",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    idp.URL,
+			Subject:   idp.subject,
+			Audience:  jwt.ClaimStrings{stubClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		},
+	})
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(idp.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+}
+
+// oidcStore keeps the few rows single sign-on touches, any other storage call panics
+type oidcStore struct {
+	database.Storage
+	logins     map[string]*types.OIDCLogin
+	accounts   []*types.Account
+	identities map[[2]string]uint
+	sessions   []*types.Session
+}
+
+func newOIDCStore(accounts ...*types.Account) *oidcStore {
+	return &oidcStore{logins: map[string]*types.OIDCLogin{}, accounts: accounts, identities: map[[2]string]uint{}}
+}
+
+func (s *oidcStore) CreateOIDCLogin(login *types.OIDCLogin) error {
+	s.logins[login.State] = login
+	return nil
+}
+
+func (s *oidcStore) TakeOIDCLogin(state string) (*types.OIDCLogin, error) {
+	login, ok := s.logins[state]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	delete(s.logins, state)
+	return login, nil
+}
+
+func (s *oidcStore) GetAccountByIdentity(issuer, subject string) (*types.Account, error) {
+	id, ok := s.identities[[2]string{issuer, subject}]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	for _, acc := range s.accounts {
+		if acc.ID == id {
+			return acc, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *oidcStore) GetAccountByEmail(email string) (*types.Account, error) {
+	for _, acc := range s.accounts {
+		if acc.Email == email {
+			return acc, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *oidcStore) GetLibraryByEmail(email string) (*types.LibraryAccount, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (s *oidcStore) CreateAccount(account *types.Account) error {
+	account.ID = uint(len(s.accounts) + 100)
+	s.accounts = append(s.accounts, account)
+	return nil
+}
+
+func (s *oidcStore) LinkIdentity(issuer, subject string, accountID uint) error {
+	s.identities[[2]string{issuer, subject}] = accountID
+	return nil
+}
+
+func (s *oidcStore) GetTwoFactor(kind string, subjectID uint) (*types.TwoFactor, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (s *oidcStore) CreateSession(session *types.Session) error {
+	s.sessions = append(s.sessions, session)
+	return nil
+}
+
+func newOIDCServer(t *testing.T, idp *stubIdP, store *oidcStore) *LibServer {
+	t.Setenv("JWT_SECRET", "test-secret")
+	provider := &oidc.Provider{
+		Issuer:      idp.URL,
+		ClientID:    stubClientID,
+		RedirectURL: "http://libraria.test/account/oidc/callback",
+		Client:      idp.Client(),
+	}
+	return &LibServer{store: store, oidc: provider}
+}
+
+// signOn walks the browser through login, the provider and back, tamper may change the callback request
+func signOn(t *testing.T, s *LibServer, idp *stubIdP, tamper func(r *http.Request)) (*httptest.ResponseRecorder, error) {
+	w := httptest.NewRecorder()
+	if err := s.OIDCLoginHandler(w, httptest.NewRequest("GET", "/account/oidc", nil)); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "x-oidc-state" {
+		t.Fatalf("login set cookies %v, want the state cookie", cookies)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorization endpoint returned %s", res.Status)
+	}
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/account/oidc/callback?"+callback.RawQuery, nil)
+	r.AddCookie(cookies[0])
+	if tamper != nil {
+		tamper(r)
+	}
+	w = httptest.NewRecorder()
+	return w, s.OIDCCallbackHandler(w, r)
+}
+
+func TestOIDCCallbackLinksVerifiedEmail(t *testing.T) {
+	idp := newStubIdP(t)
+	store := newOIDCStore(&types.Account{ID: 5, FirstName: "Ada", LastName: "Reader", Email: idp.email, Role: types.RolePatron})
+	s := newOIDCServer(t, idp, store)
+
+	w, err := signOn(t, s, idp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Errorf("callback answered %d to %q, want a redirect home", w.Code, w.Header().Get("Location"))
+	}
+	if id := store.identities[[2]string{idp.URL, idp.subject}]; id != 5 {
+		t.Errorf("identity linked to account %d, want 5", id)
+	}
+	if len(store.accounts) != 1 {
+		t.Errorf("%d accounts, the existing one should have been reused", len(store.accounts))
+	}
+	if len(store.sessions) != 1 || store.sessions[0].SubjectID != 5 {
+		t.Errorf("sessions %v, want one for account 5", store.sessions)
+	}
+
+	// a second sign-on finds the account through the identity alone
+	idp.email = "changed@example.com"
+	if _, err = signOn(t, s, idp, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.sessions) != 2 || store.sessions[1].SubjectID != 5 {
+		t.Errorf("second sign-on did not resume account 5")
+	}
+}
+
+func TestOIDCCallbackRefusesUnverifiedEmail(t *testing.T) {
+	idp := newStubIdP(t)
+	idp.verified = false
+	store := newOIDCStore(&types.Account{ID: 5, Email: idp.email, Role: types.RolePatron})
+	s := newOIDCServer(t, idp, store)
+
+	if _, err := signOn(t, s, idp, nil); err == nil || !strings.Contains(err.Error(), "did not confirm") {
+		t.Fatalf("got %v, want the unverified email refused", err)
+	}
+	if len(store.identities) != 0 || len(store.sessions) != 0 {
+		t.Error("an unverified email must not link or sign in")
+	}
+}
+
+func TestOIDCCallbackChecksVerifier(t *testing.T) {
+	idp := newStubIdP(t)
+	store := newOIDCStore()
+	s := newOIDCServer(t, idp, store)
+
+	_, err := signOn(t, s, idp, func(r *http.Request) {
+		for _, login := range store.logins {
+			login.Verifier = "not-the-verifier"
+		}
+	})
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("got %v, want the token endpoint to reject the verifier", err)
+	}
+	if len(store.sessions) != 0 {
+		t.Error("a rejected exchange must not sign in")
+	}
+}
+
+func TestOIDCCallbackNonceMismatch(t *testing.T) {
+	idp := newStubIdP(t)
+	idp.nonce = "replayed-nonce"
+	store := newOIDCStore()
+	s := newOIDCServer(t, idp, store)
+
+	if _, err := signOn(t, s, idp, nil); err == nil || !strings.Contains(err.Error(), "nonce mismatch") {
+		t.Fatalf("got %v, want a nonce mismatch", err)
+	}
+	if len(store.accounts) != 0 || len(store.sessions) != 0 {
+		t.Error("a token with a foreign nonce must not create or sign in an account")
+	}
+}
+
+func TestOIDCCallbackStateMismatch(t *testing.T) {
+	idp := newStubIdP(t)
+	store := newOIDCStore()
+	s := newOIDCServer(t, idp, store)
+
+	_, err := signOn(t, s, idp, func(r *http.Request) {
+		query := r.URL.Query()
+		query.Set("state", "forged")
+		r.URL.RawQuery = query.Encode()
+	})
+	if err == nil || !strings.Contains(err.Error(), "state mismatch") {
+		t.Fatalf("got %v, want a state mismatch", err)
+	}
+	if idp.exchanges != 0 {
+		t.Error("the code must not be exchanged when the state does not match")
+	}
+	if len(store.logins) != 1 {
+		t.Error("a forged callback must not use up the pending sign-on")
+	}
+}
@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"Libraria/types"
+	"Libraria/utils"
+	"net/http"
+)
+
+// OutboxHandler lists queued emails for admins, dead ones unless ?status= asks for another state
+func (s *LibServer) OutboxHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return utils.MethodNotAllowed(w)
+	}
+	if _, err := adminPrincipal(r); err != nil {
+		return err
+	}
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = types.OutboxDead
+	case types.OutboxPending, types.OutboxSent, types.OutboxDead:
+	default:
+		return WriteJSON(w, http.StatusBadRequest, "Unknown status "+status)
+	}
+	messages, err := s.store.GetOutboxMessages(status)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, messages)
+}
+
+// OutboxResendHandler queues a dead email again
+func (s *LibServer) OutboxResendHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return utils.MethodNotAllowed(w)
+	}
+	if _, err := adminPrincipal(r); err != nil {
+		return err
+	}
+	id, err := utils.GetID(r)
+	if err != nil {
+		return err
+	}
+	if err = s.store.ResendOutboxMessage(id); err != nil {
+		return WriteJSON(w, http.StatusNotFound, "No failed email with this id, or its link has expired")
+	}
+	return WriteJSON(w, http.StatusOK, "Email queued for delivery")
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"Libraria/types"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type principalKey struct{}
+
+// withPrincipal validates the access token once per request and stores its principal in the context
+func (s *LibServer) withPrincipal(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if principal, err := s.readToken(r); err == nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *LibServer) readToken(r *http.Request) (*types.Principal, error) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return s.readAPIKey(auth)
+	}
+	tokenString, err := r.Cookie("x-jwt-token")
+	if err != nil {
+		return nil, ErrorUnauthorized
+	}
+	claims, err := validateJWT(tokenString.Value)
+	if err != nil {
+		return nil, ErrorUnauthorized
+	}
+	id, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil || !s.store.IsSessionActive(claims.SessionID) {
+		return nil, ErrorUnauthorized
+	}
+	return &types.Principal{
+		SubjectID: uint(id),
+		Kind:      claims.Kind,
+		Roles:     claims.Roles,
+		SessionID: claims.SessionID,
+	}, nil
+}
+
+// readAPIKey accepts an "Authorization: Bearer <key>" header in place of the session cookie
+func (s *LibServer) readAPIKey(auth string) (*types.Principal, error) {
+	key, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok || !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, ErrorUnauthorized
+	}
+	apiKey, err := s.store.UseAPIKey(hashToken(key))
+	if err != nil {
+		return nil, ErrorUnauthorized
+	}
+	return types.NewAPIKeyPrincipal(apiKey), nil
+}
+
+func getPrincipal(r *http.Request) (*types.Principal, error) {
+	principal, ok := r.Context().Value(principalKey{}).(*types.Principal)
+	if !ok {
+		return nil, ErrorUnauthorized
+	}
+	return principal, nil
+}
+
+// accountPrincipal returns the signed in patron or admin account
+func accountPrincipal(r *http.Request) (*types.Principal, error) {
+	principal, err := getPrincipal(r)
+	if err != nil || !principal.IsAccount() {
+		return nil, ErrorUnauthorized
+	}
+	return principal, nil
+}
+
+// adminPrincipal returns the signed in admin account, API keys never qualify
+func adminPrincipal(r *http.Request) (*types.Principal, error) {
+	principal, err := getPrincipal(r)
+	if err != nil || principal.IsAPIKey() || !principal.HasRole(types.RoleAdmin) {
+		return nil, ErrorUnauthorized
+	}
+	return principal, nil
+}
+
+// libraryPrincipal returns the signed in library account
+func libraryPrincipal(r *http.Request) (*types.Principal, error) {
+	principal, err := getPrincipal(r)
+	if err != nil || !principal.IsLibrary() {
+		return nil, ErrorUnauthorized
+	}
+	return principal, nil
+}
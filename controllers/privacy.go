@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"Libraria/types"
+	"Libraria/utils"
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// AccountExportHandler hands the signed in account everything stored about it, as a zip of JSON files by default
+func (s *LibServer) AccountExportHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := accountPrincipal(r)
+	if err != nil {
+		return err
+	}
+	export, err := s.store.ExportAccount(int(principal.SubjectID))
+	if err != nil {
+		return err
+	}
+	export.Redact()
+	name := fmt.Sprintf("libraria-export-%s", export.ExportedAt.Format("2006-01-02"))
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+name+".json\"")
+		return WriteJSON(w, http.StatusOK, export)
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+".zip\"")
+	archive := zip.NewWriter(w)
+	files := []struct {
+		name string
+		data any
+	}{
+		{"account.json", export.Account},
+		{"last_books.json", export.LastBooks},
+		{"loans.json", export.Loans},
+		{"holds.json", export.Holds},
+		{"sessions.json", export.Sessions},
+		{"security.json", map[string]any{"twoFactorEnabled": export.TwoFactorEnabled, "identities": export.Identities, "emailChanges": export.EmailChanges}},
+		{"export.json", export},
+	}
+	for _, file := range files {
+		f, err := archive.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: export.ExportedAt})
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(file.data); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// AccountDeleteHandler mails a confirmation link, nothing is removed until it is followed
+func (s *LibServer) AccountDeleteHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := accountPrincipal(r)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	// Limited before the password check, a stolen session must not be able to guess it at full speed
+	if err = s.rateLimit(r, "delete", subjectKey(principal), resetIPLimit, resetEmailLimit); err != nil {
+		return err
+	}
+	user, err := s.store.GetAccountByID(int(principal.SubjectID))
+	if err != nil {
+		return err
+	}
+	if user.Password != "" && !user.ValidPassword(req.Password) {
+		return utils.NotAuthenticated(w)
+	}
+
+	deletion := &types.AccountDeletion{
+		AccountID: user.ID,
+		Tag:       s.store.MakeToken("account_deletions"),
+		ExpiresAt: time.Now().Add(expiration * time.Minute).UTC(),
+	}
+	if err = s.store.CreateAccountDeletion(deletion); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Error connecting to db, please try again later")
+	}
+	appeal := user.FirstName + " " + user.LastName
+	message, err := s.email.AccountDeletion(user.Email, s.recipientLocale(r, types.SessionAccount, user.ID), appeal, domain+"/account/delete/"+deletion.Tag)
+	if err != nil {
+		return err
+	}
+	if err = s.email.Send(message); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Error sending email, please try again later")
+	}
+	return WriteJSON(w, http.StatusOK, "Message has been sent to email: "+user.Email)
+}
+
+func (s *LibServer) AccountDeleteConfirmHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" && r.Method != "GET" {
+		return utils.MethodNotAllowed(w)
+	}
+	tag := utils.GetTAG(r)
+	if !utils.ValidTag(tag) {
+		return WriteJSON(w, http.StatusBadRequest, "Incorrect link")
+	}
+	// Following the link only shows the page, mail scanners opening it must not delete anything
+	if r.Method == "GET" {
+		html, err := os.ReadFile("static/accountDelete.html")
+		if err != nil {
+			return err
+		}
+		token, err := json.Marshal(tag)
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(w, "<script> var token = %s; </script>", token); err != nil {
+			return err
+		}
+		_, err = w.Write(html)
+		return err
+	}
+	deletion, err := s.store.GetAccountDeletionByTAG(tag)
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Incorrect link")
+	}
+	books, err := s.store.DeleteAccount(deletion.AccountID)
+	if err != nil {
+		return err
+	}
+	for _, book := range *books {
+		s.serveHolds(book.BookID, book.LibraryID)
+	}
+	deleteJWT(w)
+	return WriteJSON(w, http.StatusOK, "Account has been deleted")
+}
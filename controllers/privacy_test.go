@@ -0,0 +1,237 @@
+package controllers
+
+import (
+	"Libraria/database"
+	"Libraria/mail"
+	"Libraria/types"
+	"Libraria/utils"
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// privacyStore keeps one account and its pending deletions, any other storage call panics
+type privacyStore struct {
+	database.Storage
+	account   *types.Account
+	export    *types.AccountExport
+	deletions map[string]*types.AccountDeletion
+	deleted   []uint
+}
+
+func (s *privacyStore) GetAccountByID(id int) (*types.Account, error) {
+	if s.account == nil || int(s.account.ID) != id {
+		return nil, sql.ErrNoRows
+	}
+	return s.account, nil
+}
+
+func (s *privacyStore) ExportAccount(id int) (*types.AccountExport, error) {
+	return s.export, nil
+}
+
+func (s *privacyStore) MakeToken(table string) string {
+	return strings.Repeat("a", 63) + string(rune('a'+len(s.deletions)))
+}
+
+func (s *privacyStore) CreateAccountDeletion(deletion *types.AccountDeletion) error {
+	s.deletions[deletion.Tag] = deletion
+	return nil
+}
+
+// GetAccountDeletionByTAG skips expired links like the SQL does
+func (s *privacyStore) GetAccountDeletionByTAG(tag string) (*types.AccountDeletion, error) {
+	deletion, ok := s.deletions[tag]
+	if !ok || deletion.ExpiresAt.Before(time.Now()) {
+		return nil, sql.ErrNoRows
+	}
+	return deletion, nil
+}
+
+func (s *privacyStore) DeleteAccount(id uint) (*[]types.LibraryBook, error) {
+	s.deleted = append(s.deleted, id)
+	return &[]types.LibraryBook{}, nil
+}
+
+func (s *privacyStore) GetLocale(kind string, subjectID uint) (string, error) {
+	return "", nil
+}
+
+func newPrivacyServer(t *testing.T, password string) (*LibServer, *privacyStore, *mail.MemoryTransport) {
+	t.Helper()
+	account := &types.Account{ID: 5, FirstName: "Ada", LastName: "Reader", Email: "reader@example.com", Password: password, Role: types.RolePatron}
+	if password != "" {
+		if err := account.PasswordHash(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	templates, err := mail.LoadTemplates("../templates/email", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &mail.MemoryTransport{}
+	store := &privacyStore{account: account, deletions: map[string]*types.AccountDeletion{}}
+	s := &LibServer{store: store, email: mail.NewEmail(transport, templates, "no-reply@libraria.test"), limiter: utils.NewMemoryLimiter()}
+	return s, store, transport
+}
+
+func privacyRequest(method, target, body string, principal *types.Principal) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+}
+
+func TestAccountDeleteRequiresPassword(t *testing.T) {
+	patron := types.NewAccountPrincipal(&types.Account{ID: 5, Role: types.RolePatron})
+	tests := []struct {
+		name     string
+		password string
+		body     string
+		wantCode int
+		wantMail bool
+	}{
+		{"wrong password", "correct horse", `{"password":"battery staple"}`, http.StatusUnauthorized, false},
+		{"missing password", "correct horse", `{}`, http.StatusUnauthorized, false},
+		{"right password", "correct horse", `{"password":"correct horse"}`, http.StatusOK, true},
+		{"single sign-on account", "", `{}`, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		s, store, transport := newPrivacyServer(t, tt.password)
+		w := httptest.NewRecorder()
+		if err := s.AccountDeleteHandler(w, privacyRequest("POST", "/account/delete", tt.body, patron)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		if sent := len(transport.Messages()) == 1 && len(store.deletions) == 1; sent != tt.wantMail {
+			t.Errorf("%s: confirmation sent %v, want %v", tt.name, sent, tt.wantMail)
+		}
+		if len(store.deleted) != 0 {
+			t.Errorf("%s: account deleted before the link was followed", tt.name)
+		}
+	}
+}
+
+func TestAccountDeleteLimitsGuesses(t *testing.T) {
+	s, _, _ := newPrivacyServer(t, "correct horse")
+	patron := types.NewAccountPrincipal(&types.Account{ID: 5, Role: types.RolePatron})
+	var err error
+	for i := 0; i <= int(resetEmailLimit.Burst) && err == nil; i++ {
+		err = s.AccountDeleteHandler(httptest.NewRecorder(), privacyRequest("POST", "/account/delete", `{"password":"guess"}`, patron))
+	}
+	var limitErr *utils.RateLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("got %v, want wrong passwords to run into the limit", err)
+	}
+}
+
+func TestAccountDeleteConfirm(t *testing.T) {
+	s, store, _ := newPrivacyServer(t, "correct horse")
+	// the page is read relative to the repository root
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	valid := strings.Repeat("v", 64)
+	expired := strings.Repeat("e", 64)
+	tests := []struct {
+		name        string
+		method      string
+		tag         string
+		wantCode    int
+		wantDeleted bool
+	}{
+		{"GET only shows the page", "GET", valid, http.StatusOK, false},
+		{"GET with a script in the tag", "GET", `";alert(1);"` + strings.Repeat("x", 52), http.StatusBadRequest, false},
+		{"GET with a short tag", "GET", "abc", http.StatusBadRequest, false},
+		{"POST unknown tag", "POST", strings.Repeat("u", 64), http.StatusBadRequest, false},
+		{"POST expired tag", "POST", expired, http.StatusBadRequest, false},
+		{"POST valid tag", "POST", valid, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		store.deleted = nil
+		store.deletions[valid] = &types.AccountDeletion{AccountID: 5, Tag: valid, ExpiresAt: time.Now().Add(time.Minute)}
+		store.deletions[expired] = &types.AccountDeletion{AccountID: 5, Tag: expired, ExpiresAt: time.Now().Add(-time.Minute)}
+
+		r := mux.SetURLVars(httptest.NewRequest(tt.method, "/account/delete/x", nil), map[string]string{"tag": tt.tag})
+		w := httptest.NewRecorder()
+		if err := s.AccountDeleteConfirmHandler(w, r); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		if deleted := len(store.deleted) == 1; deleted != tt.wantDeleted {
+			t.Errorf("%s: deleted %v, want %v", tt.name, deleted, tt.wantDeleted)
+		}
+		if strings.Contains(w.Body.String(), "alert(1)") {
+			t.Errorf("%s: the tag was written into the page", tt.name)
+		}
+		if tt.method == "GET" && tt.wantCode == http.StatusOK && !strings.Contains(w.Body.String(), `var token = "`+tt.tag+`";`) {
+			t.Errorf("%s: page does not carry the token", tt.name)
+		}
+	}
+}
+
+func TestAccountExportOmitsSecrets(t *testing.T) {
+	s, store, _ := newPrivacyServer(t, "correct horse")
+	now := time.Now().UTC()
+	store.export = &types.AccountExport{
+		ExportedAt: now,
+		Account:    *store.account,
+		Sessions:   []types.Session{{ID: "s1", Kind: types.SessionAccount, SubjectID: 5, RefreshHash: "refresh-secret", PreviousHash: "previous-secret"}},
+		EmailChanges: []types.EmailChangeRequest{{ID: 1, Kind: types.SessionAccount, SubjectID: 5, OldEmail: "reader@example.com",
+			Email: "new@example.com", Tag: "change-tag-secret"}},
+		Emails: []types.OutboxMessage{{ID: 1, Recipient: "reader@example.com", Subject: "Confirm", Body: "body-secret", HTML: "<p>html-secret</p>"}},
+	}
+	secrets := []string{store.account.Password, "refresh-secret", "previous-secret", "change-tag-secret", "body-secret", "html-secret"}
+	patron := types.NewAccountPrincipal(&types.Account{ID: 5, Role: types.RolePatron})
+
+	for _, target := range []string{"/account/export?format=json", "/account/export"} {
+		w := httptest.NewRecorder()
+		if err := s.AccountExportHandler(w, privacyRequest("GET", target, "", patron)); err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		contents := w.Body.String()
+		if w.Header().Get("Content-Type") == "application/zip" {
+			archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+			if err != nil {
+				t.Fatalf("%s: %v", target, err)
+			}
+			contents = ""
+			for _, f := range archive.File {
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, _ := io.ReadAll(rc)
+				rc.Close()
+				contents += string(data)
+			}
+		}
+		if !strings.Contains(contents, "new@example.com") {
+			t.Errorf("%s: export is missing the email change", target)
+		}
+		for _, secret := range secrets {
+			if strings.Contains(contents, secret) {
+				t.Errorf("%s: export contains %q", target, secret)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"Libraria/database"
+	"Libraria/types"
+	"Libraria/utils"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	loginIPLimit    = types.RateLimit{Burst: 20, Every: 30 * time.Second}
+	loginEmailLimit = types.RateLimit{Burst: 5, Every: time.Minute}
+	resetIPLimit    = types.RateLimit{Burst: 5, Every: 5 * time.Minute}
+	resetEmailLimit = types.RateLimit{Burst: 2, Every: 15 * time.Minute}
+	loginLockout    = types.Lockout{MaxFailures: 5, Window: 15 * time.Minute, Duration: 15 * time.Minute}
+)
+
+// storeLimiter keeps buckets in Postgres so that several instances share them
+type storeLimiter struct {
+	store database.Storage
+}
+
+func (l storeLimiter) Take(limits map[string]types.RateLimit) (time.Duration, error) {
+	return l.store.TakeRateTokens(limits)
+}
+
+func newLimiter(store database.Storage) utils.Limiter {
+	if os.Getenv("RATE_LIMIT_STORE") == "postgres" {
+		return storeLimiter{store: store}
+	}
+	return utils.NewMemoryLimiter()
+}
+
+// rateLimit takes a token for the client IP and for the email, the request is turned away if either bucket
+// is empty. A turned away request costs neither bucket, so a flood aimed at one inbox does not lock out its IP
+func (s *LibServer) rateLimit(r *http.Request, action, email string, ipLimit, emailLimit types.RateLimit) error {
+	wait, err := s.limiter.Take(map[string]types.RateLimit{
+		action + ":ip:" + utils.GetIP(r): ipLimit,
+		action + ":email:" + email:       emailLimit,
+	})
+	// An unreachable limiter should not lock everyone out
+	if err != nil {
+		fmt.Println("Error while rate limiting:", err)
+		return nil
+	}
+	if wait > 0 {
+		return &utils.RateLimitError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// subjectKey limits by the signed in user rather than by an email that the request may be changing
+func subjectKey(principal *types.Principal) string {
+	return fmt.Sprintf("%s:%d", principal.SessionKind(), principal.SubjectID)
+}
+
+func (s *LibServer) checkLockout(email string) error {
+	lockedUntil, err := s.store.GetLockedUntil(email)
+	if err != nil {
+		return err
+	}
+	if lockedUntil != nil {
+		return &utils.RateLimitError{RetryAfter: time.Until(*lockedUntil)}
+	}
+	return nil
+}
+
+// loginFailed counts the failure and reports the lockout once too many have piled up
+func (s *LibServer) loginFailed(email string) error {
+	lockedUntil, err := s.store.RecordLoginFailure(email, loginLockout)
+	if err != nil {
+		return err
+	}
+	if lockedUntil != nil {
+		return &utils.RateLimitError{RetryAfter: time.Until(*lockedUntil)}
+	}
+	return nil
+}
+
+// guardLogin is run before the credentials are checked
+func (s *LibServer) guardLogin(r *http.Request, email string) error {
+	if err := s.rateLimit(r, "login", email, loginIPLimit, loginEmailLimit); err != nil {
+		return err
+	}
+	return s.checkLockout(email)
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"Libraria/mail"
+	"Libraria/types"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	eventHoldReady = "hold_ready"
+	day            = 24 * time.Hour
+)
+
+// parseDays reads a comma separated list of days such as "3,1", sorted ascending.
+// An invalid list falls back to the default and is returned as an error for the job to report
+func parseDays(name string, fallback []int) ([]int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	var days []int
+	for _, part := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n <= 0 {
+			return fallback, fmt.Errorf("invalid %s %q, using the default", name, value)
+		}
+		days = append(days, n)
+	}
+	sort.Ints(days)
+	return days, nil
+}
+
+// sendDueReminders warns patrons before a loan is due, only the closest step is sent,
+// so a loan issued for a day gets one reminder and not all of them at once
+func (s *LibServer) sendDueReminders(ctx context.Context) error {
+	if len(s.reminderDays) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	loans, err := s.store.GetLoansDueBetween(now, now.Add(time.Duration(s.reminderDays[len(s.reminderDays)-1])*day))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, loan := range *loans {
+		if err = ctx.Err(); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		step := 0
+		for _, days := range s.reminderDays {
+			if !loan.DueAt.After(now.Add(time.Duration(days) * day)) {
+				step = days
+				break
+			}
+		}
+		loan := loan
+		err = s.notifyPatron(fmt.Sprintf("due_%d", step), loan.ID, loan.UserID, &loan.DueAt, func(acc *types.Account, locale, appeal string) (*mail.Message, error) {
+			return s.email.DueReminder(acc.Email, locale, appeal, loan.BookName, loan.LibraryName, loan.DueAt)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("due reminder for loan %d: %w", loan.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sendOverdueNotices escalates through OVERDUE_DAYS, the last step is the final notice
+func (s *LibServer) sendOverdueNotices(ctx context.Context) error {
+	if len(s.overdueDays) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	loans, err := s.store.GetLoansDueBetween(time.Time{}, now.Add(-time.Duration(s.overdueDays[0])*day))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, loan := range *loans {
+		if err = ctx.Err(); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		overdue := int(now.Sub(loan.DueAt) / day)
+		step, final := 0, false
+		for i, days := range s.overdueDays {
+			if overdue >= days {
+				step, final = days, i == len(s.overdueDays)-1
+			}
+		}
+		loan := loan
+		err = s.notifyPatron(fmt.Sprintf("overdue_%d", step), loan.ID, loan.UserID, nil, func(acc *types.Account, locale, appeal string) (*mail.Message, error) {
+			return s.email.Overdue(acc.Email, locale, appeal, loan.BookName, loan.LibraryName, loan.DueAt, overdue, final)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("overdue notice for loan %d: %w", loan.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sendHoldReadyAlerts tells patrons a copy is waiting for them on the pickup shelf
+func (s *LibServer) sendHoldReadyAlerts(ctx context.Context) error {
+	holds, err := s.store.GetReadyHolds()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, hold := range *holds {
+		if err = ctx.Err(); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		if hold.ExpiresAt == nil {
+			continue
+		}
+		hold := hold
+		err = s.notifyPatron(eventHoldReady, hold.ID, hold.UserID, hold.ExpiresAt, func(acc *types.Account, locale, appeal string) (*mail.Message, error) {
+			return s.email.HoldReady(acc.Email, locale, appeal, hold.BookName, hold.LibraryName, *hold.ExpiresAt)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("hold ready alert for hold %d: %w", hold.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// notifyPatron queues the message unless the event was already recorded for refID,
+// the outbox drops it undelivered once expiresAt passes
+func (s *LibServer) notifyPatron(event string, refID, userID uint, expiresAt *time.Time, compose func(acc *types.Account, locale, appeal string) (*mail.Message, error)) error {
+	done, err := s.store.Notified(event, refID)
+	if err != nil || done {
+		return err
+	}
+	acc, err := s.store.GetAccountByID(int(userID))
+	if err != nil {
+		return err
+	}
+	message, err := compose(acc, s.recipientLocale(nil, types.SessionAccount, acc.ID), acc.FirstName+" "+acc.LastName)
+	if err != nil {
+		return err
+	}
+	_, err = s.store.NotifyOnce(event, refID, mail.NewOutboxMessage(message, expiresAt))
+	return err
+}
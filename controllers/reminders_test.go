@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"Libraria/database"
+	"Libraria/types"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDays(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []int
+		wantErr bool
+	}{
+		{"", []int{3, 1}, false},
+		{"1, 7,3", []int{1, 3, 7}, false},
+		{"1,soon", []int{3, 1}, true},
+		{"0", []int{3, 1}, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("REMINDER_DAYS", tt.value)
+		got, err := parseDays("REMINDER_DAYS", []int{3, 1})
+		if (err != nil) != tt.wantErr || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%q: got %v, %v", tt.value, got, err)
+		}
+	}
+}
+
+// reminderStore has loans due for patrons whose accounts are gone, any other storage call panics
+type reminderStore struct {
+	database.Storage
+	loans []types.Loan
+}
+
+func (s *reminderStore) GetLoansDueBetween(from, to time.Time) (*[]types.Loan, error) {
+	return &s.loans, nil
+}
+
+func (s *reminderStore) Notified(event string, refID uint) (bool, error) {
+	return false, nil
+}
+
+func (s *reminderStore) GetAccountByID(id int) (*types.Account, error) {
+	return nil, sql.ErrNoRows
+}
+
+func TestDueRemindersReportFailures(t *testing.T) {
+	due := time.Now().UTC().Add(12 * time.Hour)
+	store := &reminderStore{loans: []types.Loan{{ID: 7, UserID: 1, DueAt: due}, {ID: 8, UserID: 2, DueAt: due}}}
+	s := &LibServer{store: store, reminderDays: []int{1, 3}}
+	err := s.sendDueReminders(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "loan 7") || !strings.Contains(err.Error(), "loan 8") {
+		t.Fatalf("got %v, want both failed loans reported to the scheduler", err)
+	}
+}
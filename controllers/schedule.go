@@ -0,0 +1,46 @@
+package controllers
+
+import (
+	"Libraria/types"
+	"Libraria/utils"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+func (s *LibServer) LibraryScheduleHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" && r.Method != "POST" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := libraryPrincipal(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		schedule, err := s.store.GetLibrarySchedule(int(principal.SubjectID))
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, schedule)
+	}
+	var schedule types.LibrarySchedule
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		return err
+	}
+	if err := schedule.ValidateSchedule(); err != nil {
+		return err
+	}
+	if err := s.store.UpdateLibrarySchedule(int(principal.SubjectID), &schedule); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, schedule)
+}
+
+func withHours(lib types.LibraryWeb, schedule *types.LibrarySchedule) types.LibraryHours {
+	hours := types.LibraryHours{LibraryWeb: lib}
+	if schedule.HasHours() {
+		hours.OpenNow, hours.NextOpening = schedule.Status(time.Now())
+		hours.Schedule = schedule
+	}
+	return hours
+}
@@ -21,29 +21,28 @@ func (s *LibServer) SearchHandler(w http.ResponseWriter, r *http.Request) error
 	if r.Method != "POST" {
 		return utils.MethodNotAllowed(w)
 	}
-	var inJson struct {
-		Input string `json:"inputValue"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&inJson); err != nil {
+	var params types.SearchParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
 		fmt.Println(err)
 		return err
 	}
-	books, libs, err := s.store.SearchBookName(inJson.Input)
+	if err := params.ValidateSearch(); err != nil {
+		return err
+	}
+	result, err := s.store.SearchBooks(&params)
 	if err != nil {
 		return err
 	}
-	ret := struct {
-		Books     []types.Book       `json:"books"`
-		Libraries []types.LibraryWeb `json:"libraries"`
-	}{
-		Books:     *books,
-		Libraries: *libs,
+	return WriteJSON(w, http.StatusOK, result)
+}
+
+func (s *LibServer) AutocompleteHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return utils.MethodNotAllowed(w)
 	}
-	jsonBooks, err := json.Marshal(ret)
+	suggestions, err := s.store.Autocomplete(r.URL.Query().Get("q"), 10)
 	if err != nil {
 		return err
 	}
-	w.Header().Add("Content-Type", "application/json")
-	_, err = w.Write(jsonBooks)
-	return err
+	return WriteJSON(w, http.StatusOK, suggestions)
 }
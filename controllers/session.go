@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"Libraria/types"
+	"Libraria/utils"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	accessTokenTime  = 15 * time.Minute
+	refreshTokenTime = 14 * 24 * time.Hour
+	// A just rotated refresh token is still honoured briefly, pages fire several requests at once
+	refreshGraceTime = 30 * time.Second
+	// Accounts without a password prove who they are by a sign-on at most this old
+	freshSignOnTime = 10 * time.Minute
+)
+
+func newToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func setAuthCookies(w http.ResponseWriter, access string, accessExpires time.Time, refresh string, refreshExpires time.Time) http.Cookie {
+	cookie := http.Cookie{
+		Name:     "x-jwt-token",
+		Value:    access,
+		HttpOnly: true,
+		Path:     "/",
+		Expires:  accessExpires,
+	}
+	http.SetCookie(w, &cookie)
+	if refresh != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     "x-refresh-token",
+			Value:    refresh,
+			HttpOnly: true,
+			Path:     "/",
+			Expires:  refreshExpires,
+		})
+	}
+	return cookie
+}
+
+// startSession records a new server-side session and hands out its access and refresh tokens
+func (s *LibServer) startSession(w http.ResponseWriter, principal *types.Principal) (http.Cookie, error) {
+	sid, err := newToken(16)
+	if err != nil {
+		return http.Cookie{}, err
+	}
+	refresh, err := newToken(32)
+	if err != nil {
+		return http.Cookie{}, err
+	}
+	now := time.Now().UTC()
+	session := &types.Session{
+		ID:          sid,
+		Kind:        principal.SessionKind(),
+		SubjectID:   principal.SubjectID,
+		RefreshHash: hashToken(refresh),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(refreshTokenTime),
+	}
+	if err = s.store.CreateSession(session); err != nil {
+		return http.Cookie{}, err
+	}
+	principal.SessionID = sid
+	access, accessExpires, err := createJWT(principal)
+	if err != nil {
+		return http.Cookie{}, err
+	}
+	return setAuthCookies(w, access, accessExpires, refresh, session.ExpiresAt), nil
+}
+
+// loadPrincipal builds the principal for a session kind and subject from the stored account
+func (s *LibServer) loadPrincipal(kind string, subjectID uint) (*types.Principal, error) {
+	if kind == types.SessionLibrary {
+		lib, err := s.store.GetLibraryByID(int(subjectID))
+		if err != nil {
+			return nil, ErrorUnauthorized
+		}
+		return types.NewLibraryPrincipal(lib), nil
+	}
+	acc, err := s.store.GetAccountByID(int(subjectID))
+	if err != nil {
+		return nil, ErrorUnauthorized
+	}
+	return types.NewAccountPrincipal(acc), nil
+}
+
+// refreshSession trades the refresh cookie for a new access token and rotates the refresh token
+func (s *LibServer) refreshSession(w http.ResponseWriter, r *http.Request) (http.Cookie, error) {
+	refreshCookie, err := r.Cookie("x-refresh-token")
+	if err != nil {
+		return http.Cookie{}, ErrorUnauthorized
+	}
+	hash := hashToken(refreshCookie.Value)
+	session, err := s.store.GetSessionByRefreshHash(hash)
+	if err != nil || session.RevokedAt != nil || time.Now().UTC().After(session.ExpiresAt) {
+		return http.Cookie{}, ErrorUnauthorized
+	}
+
+	// Roles are read again so that changes apply on the next refresh
+	principal, err := s.loadPrincipal(session.Kind, session.SubjectID)
+	if err != nil {
+		return http.Cookie{}, err
+	}
+	principal.SessionID = session.ID
+
+	refresh := ""
+	if hash == session.PreviousHash {
+		// An old refresh token showing up after the grace period means it was stolen
+		if session.RotatedAt == nil || time.Now().UTC().Sub(*session.RotatedAt) > refreshGraceTime {
+			s.store.RevokeSession(session.ID)
+			return http.Cookie{}, ErrorUnauthorized
+		}
+	} else {
+		if refresh, err = newToken(32); err != nil {
+			return http.Cookie{}, err
+		}
+		session.ExpiresAt = time.Now().UTC().Add(refreshTokenTime)
+		if err = s.store.RotateSession(session.ID, hashToken(refresh), session.ExpiresAt); err != nil {
+			return http.Cookie{}, err
+		}
+	}
+
+	access, accessExpires, err := createJWT(principal)
+	if err != nil {
+		return http.Cookie{}, err
+	}
+	return setAuthCookies(w, access, accessExpires, refresh, session.ExpiresAt), nil
+}
+
+// withSessionRefresh transparently renews an expired access token so pages keep working
+func (s *LibServer) withSessionRefresh(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tokenString, err := r.Cookie("x-jwt-token"); err == nil {
+			if _, err := validateJWT(tokenString.Value); err == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if _, err := r.Cookie("x-refresh-token"); err != nil || r.URL.Path == "/auth/refresh" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cookie, err := s.refreshSession(w, r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Let the handlers below see the fresh access token
+		cookies := r.Cookies()
+		r.Header.Del("Cookie")
+		for _, c := range cookies {
+			if c.Name != "x-jwt-token" {
+				r.AddCookie(c)
+			}
+		}
+		r.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *LibServer) RefreshHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return utils.MethodNotAllowed(w)
+	}
+	cookie, err := s.refreshSession(w, r)
+	if err != nil {
+		deleteJWT(w)
+		return utils.NotAuthenticated(w)
+	}
+	return WriteJSON(w, http.StatusOK, cookie)
+}
+
+func (s *LibServer) LogoutAllHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := getPrincipal(r)
+	if err != nil {
+		return err
+	}
+	if principal.IsAPIKey() {
+		return ErrorUnauthorized
+	}
+	if err = s.store.RevokeSessions(principal.SessionKind(), principal.SubjectID); err != nil {
+		return err
+	}
+	deleteJWT(w)
+	return WriteJSON(w, http.StatusOK, "Logged out of all devices")
+}
+
+// revokeSession ends the session behind the request's access or refresh token
+func (s *LibServer) revokeSession(r *http.Request) {
+	if principal, err := getPrincipal(r); err == nil {
+		if err = s.store.RevokeSession(principal.SessionID); err != nil {
+			fmt.Println("Error while revoking session:", err)
+		}
+		return
+	}
+	if refreshCookie, err := r.Cookie("x-refresh-token"); err == nil {
+		if session, err := s.store.GetSessionByRefreshHash(hashToken(refreshCookie.Value)); err == nil {
+			s.store.RevokeSession(session.ID)
+		}
+	}
+}
@@ -1,12 +1,14 @@
 package controllers
 
 import (
+	"Libraria/mail"
 	"Libraria/types"
 	"Libraria/utils"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -24,7 +26,6 @@ func (s *LibServer) PasswordResetConfirmHandler(w http.ResponseWriter, r *http.R
 		_, err = fmt.Fprintf(w, string(html))
 		return err
 	}
-	s.store.OneTimeClear()
 	token := utils.GetTAG(r)
 	req, err := s.store.GetPasswordReset(token)
 	fmt.Println(req, err, token)
@@ -39,6 +40,9 @@ func (s *LibServer) PasswordResetConfirmHandler(w http.ResponseWriter, r *http.R
 	if newPw.NewPassword != newPw.NewPasswordConfirm {
 		return WriteJSON(w, http.StatusBadRequest, "Incorrect link")
 	}
+	if err = types.ValidatePassword(newPw.NewPassword); err != nil {
+		return err
+	}
 
 	user, err1 := s.store.GetAccountByEmail(req.Email)
 	library, err2 := s.store.GetLibraryByEmail(req.Email)
@@ -52,15 +56,22 @@ func (s *LibServer) PasswordResetConfirmHandler(w http.ResponseWriter, r *http.R
 		if err != nil {
 			return WriteJSON(w, http.StatusBadRequest, "Incorrect link") //relocate
 		}
-		s.store.UpdateAccount(user)
+		if err = s.store.UpdateAccountPassword(user); err != nil {
+			return err
+		}
+		s.store.RevokeSessions(types.SessionAccount, user.ID)
 	} else {
 		library.Password = newPw.NewPassword
 		err = library.PasswordHash()
 		if err != nil {
 			return WriteJSON(w, http.StatusBadRequest, "Incorrect link") //relocate
 		}
-		s.store.UpdateLibrary(library)
+		if err = s.store.UpdateLibraryPassword(library); err != nil {
+			return err
+		}
+		s.store.RevokeSessions(types.SessionLibrary, library.ID)
 	}
+	s.store.DeletePasswordReset(req)
 	return WriteJSON(w, http.StatusOK, "Password has been changed")
 }
 
@@ -76,13 +87,16 @@ func (s *LibServer) PasswordResetHandler(w http.ResponseWriter, r *http.Request)
 		_, err = fmt.Fprintf(w, string(html))
 		return err
 	}
-	s.store.OneTimeClear()
 	var jspost struct {
 		Email string `json:"email"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&jspost); err != nil {
 		return err
 	}
+	// Every request sends an email, so both the sender and the inbox are throttled
+	if err := s.rateLimit(r, "reset", normalizeEmail(jspost.Email), resetIPLimit, resetEmailLimit); err != nil {
+		return err
+	}
 	if err := s.store.CheckForRequest(jspost.Email); err != nil {
 		return err
 	}
@@ -98,19 +112,20 @@ func (s *LibServer) PasswordResetHandler(w http.ResponseWriter, r *http.Request)
 		Token:     s.store.MakeToken("password_reset"),
 		ExpiresAt: expiresAt,
 	}
-	appeal := ""
+	appeal, locale := "", ""
 	if err1 != nil {
 		appeal = library.Name + " Library"
+		locale = s.recipientLocale(r, types.SessionLibrary, library.ID)
 	}
 	if err2 != nil {
 		appeal = user.FirstName + " " + user.LastName
+		locale = s.recipientLocale(r, types.SessionAccount, user.ID)
 	}
-	err := s.email.PasswordResetMessage(request.Email, appeal, domain+"/password_reset/"+request.Token)
-
+	message, err := s.email.PasswordReset(request.Email, locale, appeal, domain+"/password_reset/"+request.Token)
 	if err != nil {
-		return WriteJSON(w, http.StatusBadRequest, "Error sending email, please try again later")
+		return err
 	}
-	err = s.store.CreatePasswordReset(request)
+	err = s.store.CreatePasswordReset(request, mail.NewOutboxMessage(message, &request.ExpiresAt))
 
 	if err != nil {
 		return WriteJSON(w, http.StatusBadRequest, "Error connecting to db, please try again later")
@@ -118,3 +133,183 @@ func (s *LibServer) PasswordResetHandler(w http.ResponseWriter, r *http.Request)
 	return WriteJSON(w, http.StatusOK, "Message has been sent to email: "+request.Email)
 	// show HTML success page
 }
+
+// EmailChangeHandler sends a confirmation link to the new address, the login email stays until it is followed
+func (s *LibServer) EmailChangeHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := getPrincipal(r)
+	if err != nil {
+		return err
+	}
+	var change types.EmailChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		return err
+	}
+	if err := change.ValidateEmailChange(); err != nil {
+		return err
+	}
+
+	// Limited before the password check, a stolen session must not be able to guess it at full speed
+	if err = s.rateLimit(r, "email", subjectKey(principal), resetIPLimit, resetEmailLimit); err != nil {
+		return err
+	}
+
+	var oldEmail, appeal string
+	if principal.IsLibrary() {
+		library, err := s.store.GetLibraryByID(int(principal.SubjectID))
+		if err != nil {
+			return err
+		}
+		if !library.ValidPassword(change.Password) {
+			return utils.NotAuthenticated(w)
+		}
+		oldEmail, appeal = library.Email, library.Name+" Library"
+	} else {
+		user, err := s.store.GetAccountByID(int(principal.SubjectID))
+		if err != nil {
+			return err
+		}
+		if user.Password != "" && !user.ValidPassword(change.Password) {
+			return utils.NotAuthenticated(w)
+		}
+		// Accounts made through single sign-on have no password, they have to sign on again instead
+		if user.Password == "" && !s.freshSignOn(principal) {
+			return WriteJSON(w, http.StatusUnauthorized, "Sign in again to change your email")
+		}
+		oldEmail, appeal = user.Email, user.FirstName+" "+user.LastName
+	}
+	if strings.EqualFold(change.Email, oldEmail) {
+		return fmt.Errorf("this is already your email")
+	}
+	isFree, err := s.store.CheckEmail(change.Email)
+	if err != nil {
+		return err
+	}
+	if !isFree {
+		return fmt.Errorf("email is already taken")
+	}
+
+	request := &types.EmailChangeRequest{
+		Kind:      principal.SessionKind(),
+		SubjectID: principal.SubjectID,
+		OldEmail:  oldEmail,
+		Email:     change.Email,
+		Tag:       s.store.MakeToken("email_changes"),
+		ExpiresAt: time.Now().Add(expiration * time.Minute).UTC(),
+	}
+	if err = s.store.CreateEmailChange(request); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Error connecting to db, please try again later")
+	}
+	locale := s.recipientLocale(r, request.Kind, request.SubjectID)
+	message, err := s.email.EmailChangeConfirm(request.Email, locale, appeal, domain+"/email_change/"+request.Tag)
+	if err != nil {
+		return err
+	}
+	if err = s.email.Send(message); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Error sending email, please try again later")
+	}
+	message, err = s.email.EmailChangeNotice(oldEmail, locale, appeal, request.Email)
+	if err == nil {
+		err = s.email.Send(message)
+	}
+	if err != nil {
+		fmt.Println("Error while notifying email change:", err)
+	}
+	return WriteJSON(w, http.StatusOK, "Message has been sent to email: "+request.Email)
+}
+
+// freshSignOn reports whether the session behind principal was signed in within freshSignOnTime,
+// refreshing the access token does not count
+func (s *LibServer) freshSignOn(principal *types.Principal) bool {
+	session, err := s.store.GetSession(principal.SessionID)
+	if err != nil || session.RevokedAt != nil {
+		return false
+	}
+	return time.Since(session.CreatedAt) < freshSignOnTime
+}
+
+func (s *LibServer) EmailChangeConfirmHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return utils.MethodNotAllowed(w)
+	}
+	request, err := s.store.GetEmailChangeByTAG(utils.GetTAG(r))
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Incorrect link")
+	}
+	// The address could have been registered while the link was waiting
+	isFree, err := s.store.CheckEmail(request.Email)
+	if err != nil {
+		return err
+	}
+	if !isFree {
+		return fmt.Errorf("email is already taken")
+	}
+	if err = s.store.ChangeEmail(request); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, "Email has been changed")
+}
+
+// PasswordChangeHandler sets a new password after checking the current one and signs out every other session
+func (s *LibServer) PasswordChangeHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := getPrincipal(r)
+	if err != nil {
+		return err
+	}
+	var change types.PasswordChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		return err
+	}
+	if change.NewPassword != change.NewPasswordConfirm {
+		return fmt.Errorf("passwords do not match")
+	}
+	if err := types.ValidatePassword(change.NewPassword); err != nil {
+		return err
+	}
+	// A stolen session must not be able to guess the current password at full speed
+	if err = s.rateLimit(r, "password", subjectKey(principal), loginIPLimit, loginEmailLimit); err != nil {
+		return err
+	}
+
+	if principal.IsLibrary() {
+		library, err := s.store.GetLibraryByID(int(principal.SubjectID))
+		if err != nil {
+			return err
+		}
+		if !library.ValidPassword(change.CurrentPassword) {
+			return utils.NotAuthenticated(w)
+		}
+		library.Password = change.NewPassword
+		if err = library.PasswordHash(); err != nil {
+			return err
+		}
+		if err = s.store.UpdateLibraryPassword(library); err != nil {
+			return err
+		}
+	} else {
+		user, err := s.store.GetAccountByID(int(principal.SubjectID))
+		if err != nil {
+			return err
+		}
+		// Accounts made through single sign-on may set a first password here
+		if user.Password != "" && !user.ValidPassword(change.CurrentPassword) {
+			return utils.NotAuthenticated(w)
+		}
+		user.Password = change.NewPassword
+		if err = user.PasswordHash(); err != nil {
+			return err
+		}
+		if err = s.store.UpdateAccountPassword(user); err != nil {
+			return err
+		}
+	}
+	if err = s.store.RevokeOtherSessions(principal.SessionKind(), principal.SubjectID, principal.SessionID); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, "Password has been changed")
+}
@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"Libraria/types"
+	"Libraria/utils"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// settingsStore adds the email change rows and one session to privacyStore
+type settingsStore struct {
+	*privacyStore
+	session *types.Session
+	changes []*types.EmailChangeRequest
+}
+
+func (s *settingsStore) GetSession(id string) (*types.Session, error) {
+	if s.session == nil || s.session.ID != id {
+		return nil, sql.ErrNoRows
+	}
+	return s.session, nil
+}
+
+func (s *settingsStore) CheckEmail(email string) (bool, error) {
+	return email != s.account.Email, nil
+}
+
+func (s *settingsStore) CreateEmailChange(request *types.EmailChangeRequest) error {
+	s.changes = append(s.changes, request)
+	return nil
+}
+
+func TestEmailChangeHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		password   string
+		body       string
+		signedInAt time.Duration
+		want       int
+	}{
+		{"wrong password", "correct horse", `{"email":"new@example.com","password":"battery staple"}`, time.Hour, http.StatusUnauthorized},
+		{"right password", "correct horse", `{"email":"new@example.com","password":"correct horse"}`, time.Hour, http.StatusOK},
+		{"single sign-on, old session", "", `{"email":"new@example.com"}`, time.Hour, http.StatusUnauthorized},
+		{"single sign-on, fresh session", "", `{"email":"new@example.com"}`, time.Minute, http.StatusOK},
+	}
+	for _, tt := range tests {
+		s, privacy, transport := newPrivacyServer(t, tt.password)
+		store := &settingsStore{privacyStore: privacy, session: &types.Session{ID: "s1", CreatedAt: time.Now().Add(-tt.signedInAt)}}
+		s.store = store
+		principal := types.NewAccountPrincipal(privacy.account)
+		principal.SessionID = "s1"
+
+		w := httptest.NewRecorder()
+		if err := s.EmailChangeHandler(w, privacyRequest("POST", "/account/email", tt.body, principal)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if changed := len(store.changes) == 1 && len(transport.Messages()) == 2; changed != (tt.want == http.StatusOK) {
+			t.Errorf("%s: change requested %v", tt.name, changed)
+		}
+	}
+}
+
+func TestEmailChangeLimitsGuesses(t *testing.T) {
+	s, privacy, _ := newPrivacyServer(t, "correct horse")
+	s.store = &settingsStore{privacyStore: privacy}
+	principal := types.NewAccountPrincipal(privacy.account)
+	var err error
+	for i := 0; i <= int(resetEmailLimit.Burst) && err == nil; i++ {
+		err = s.EmailChangeHandler(httptest.NewRecorder(), privacyRequest("POST", "/account/email", `{"email":"new@example.com","password":"guess"}`, principal))
+	}
+	var limitErr *utils.RateLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("got %v, want wrong passwords to run into the limit", err)
+	}
+}
@@ -0,0 +1,246 @@
+package controllers
+
+import (
+	"Libraria/types"
+	"Libraria/utils"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	twoFactorIssuer   = "Libraria"
+	challengeTime     = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+var twoFactorLimit = types.RateLimit{Burst: 5, Every: time.Minute}
+
+// completeLogin starts the session right away, or asks for the second factor when it is enabled
+func (s *LibServer) completeLogin(w http.ResponseWriter, principal *types.Principal) error {
+	twoFactor, cookie, err := s.beginLogin(w, principal)
+	if err != nil {
+		return err
+	}
+	if twoFactor {
+		return WriteJSON(w, http.StatusOK, map[string]bool{"twoFactor": true})
+	}
+	return WriteJSON(w, http.StatusOK, cookie)
+}
+
+// beginLogin sets the session cookies, or the challenge cookie when a second factor is still needed
+func (s *LibServer) beginLogin(w http.ResponseWriter, principal *types.Principal) (bool, http.Cookie, error) {
+	tf, err := s.store.GetTwoFactor(principal.SessionKind(), principal.SubjectID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, http.Cookie{}, err
+	}
+	if err == nil && tf.Enabled {
+		token, err := newToken(32)
+		if err != nil {
+			return false, http.Cookie{}, err
+		}
+		challenge := &types.LoginChallenge{
+			ID:        hashToken(token),
+			Kind:      principal.SessionKind(),
+			SubjectID: principal.SubjectID,
+			ExpiresAt: time.Now().UTC().Add(challengeTime),
+		}
+		if err = s.store.CreateLoginChallenge(challenge); err != nil {
+			return false, http.Cookie{}, err
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     "x-2fa-token",
+			Value:    token,
+			HttpOnly: true,
+			Path:     "/auth/2fa",
+			Expires:  challenge.ExpiresAt,
+		})
+		return true, http.Cookie{}, nil
+	}
+	cookie, err := s.startSession(w, principal)
+	return false, cookie, err
+}
+
+// TwoFactorLoginHandler is the second login step, the session is only issued after a valid code
+func (s *LibServer) TwoFactorLoginHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return utils.MethodNotAllowed(w)
+	}
+	token, err := r.Cookie("x-2fa-token")
+	if err != nil {
+		return utils.NotAuthenticated(w)
+	}
+	challenge, err := s.store.GetLoginChallenge(hashToken(token.Value))
+	if err != nil {
+		return utils.NotAuthenticated(w)
+	}
+	if err = s.rateLimit(r, "2fa", twoFactorKey(challenge.Kind, challenge.SubjectID), twoFactorLimit, twoFactorLimit); err != nil {
+		return err
+	}
+	var req types.TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	tf, err := s.store.GetTwoFactor(challenge.Kind, challenge.SubjectID)
+	if err != nil {
+		return utils.NotAuthenticated(w)
+	}
+	if ok, err := s.checkSecondFactor(tf, req.Code); err != nil || !ok {
+		return utils.NotAuthenticated(w)
+	}
+	if err = s.store.DeleteLoginChallenge(challenge.ID); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{Name: "x-2fa-token", Value: "", Path: "/auth/2fa", Expires: time.Now()})
+
+	principal, err := s.loadPrincipal(challenge.Kind, challenge.SubjectID)
+	if err != nil {
+		return err
+	}
+	cookie, err := s.startSession(w, principal)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, cookie)
+}
+
+// TwoFactorHandler shows, starts and removes the enrollment of the signed in account or library
+func (s *LibServer) TwoFactorHandler(w http.ResponseWriter, r *http.Request) error {
+	principal, err := getPrincipal(r)
+	if err != nil {
+		return err
+	}
+	kind := principal.SessionKind()
+	tf, err := s.store.GetTwoFactor(kind, principal.SubjectID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	enrolled := err == nil
+
+	switch r.Method {
+	case "GET":
+		return WriteJSON(w, http.StatusOK, map[string]bool{"enabled": enrolled && tf.Enabled})
+	case "POST":
+		if enrolled && tf.Enabled {
+			return fmt.Errorf("two-factor authentication is already enabled")
+		}
+		email, err := s.principalEmail(principal)
+		if err != nil {
+			return err
+		}
+		secret, err := utils.NewTOTPSecret()
+		if err != nil {
+			return err
+		}
+		tf = &types.TwoFactor{Kind: kind, SubjectID: principal.SubjectID, Secret: secret}
+		if err = s.store.SaveTwoFactor(tf); err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, types.TwoFactorEnrollment{
+			Secret: secret,
+			URI:    utils.TOTPURI(twoFactorIssuer, email, secret),
+		})
+	case "DELETE":
+		if !enrolled {
+			return fmt.Errorf("two-factor authentication is not enabled")
+		}
+		if err = s.rateLimit(r, "2fa", twoFactorKey(kind, principal.SubjectID), twoFactorLimit, twoFactorLimit); err != nil {
+			return err
+		}
+		var req types.TwoFactorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return err
+		}
+		// An unfinished enrollment can be dropped without a code
+		if tf.Enabled {
+			if ok, err := s.checkSecondFactor(tf, req.Code); err != nil || !ok {
+				return fmt.Errorf("invalid code")
+			}
+		}
+		if err = s.store.DisableTwoFactor(kind, principal.SubjectID); err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, "Two-factor authentication disabled")
+	}
+	return utils.MethodNotAllowed(w)
+}
+
+// TwoFactorVerifyHandler finishes the enrollment with a first code and hands out the recovery codes
+func (s *LibServer) TwoFactorVerifyHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return utils.MethodNotAllowed(w)
+	}
+	principal, err := getPrincipal(r)
+	if err != nil {
+		return err
+	}
+	kind := principal.SessionKind()
+	if err = s.rateLimit(r, "2fa", twoFactorKey(kind, principal.SubjectID), twoFactorLimit, twoFactorLimit); err != nil {
+		return err
+	}
+	var req types.TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	tf, err := s.store.GetTwoFactor(kind, principal.SubjectID)
+	if err != nil {
+		return fmt.Errorf("two-factor enrollment not started")
+	}
+	if tf.Enabled {
+		return fmt.Errorf("two-factor authentication is already enabled")
+	}
+	step, ok := utils.TOTPStep(tf.Secret, req.Code, time.Now())
+	if !ok {
+		return fmt.Errorf("invalid code")
+	}
+	if ok, err = s.store.UseTOTPStep(kind, principal.SubjectID, step); err != nil || !ok {
+		return fmt.Errorf("invalid code")
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := newToken(5)
+		if err != nil {
+			return err
+		}
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashToken(code)
+	}
+	if err = s.store.EnableTwoFactor(kind, principal.SubjectID, hashes); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, codes)
+}
+
+// checkSecondFactor accepts a fresh TOTP code or an unused recovery code
+func (s *LibServer) checkSecondFactor(tf *types.TwoFactor, code string) (bool, error) {
+	if step, ok := utils.TOTPStep(tf.Secret, code, time.Now()); ok {
+		return s.store.UseTOTPStep(tf.Kind, tf.SubjectID, step)
+	}
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return s.store.UseRecoveryCode(tf.Kind, tf.SubjectID, hashToken(code))
+}
+
+func (s *LibServer) principalEmail(principal *types.Principal) (string, error) {
+	if principal.IsLibrary() {
+		lib, err := s.store.GetLibraryByID(int(principal.SubjectID))
+		if err != nil {
+			return "", err
+		}
+		return lib.Email, nil
+	}
+	acc, err := s.store.GetAccountByID(int(principal.SubjectID))
+	if err != nil {
+		return "", err
+	}
+	return acc.Email, nil
+}
+
+func twoFactorKey(kind string, subjectID uint) string {
+	return fmt.Sprintf("%s:%d", kind, subjectID)
+}
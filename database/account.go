@@ -3,6 +3,7 @@ package database
 import (
 	"Libraria/types"
 	"fmt"
+	"time"
 )
 
 func (s *PostgresStorage) CreateAccount(account *types.Account) error {
@@ -12,7 +13,7 @@ func (s *PostgresStorage) CreateAccount(account *types.Account) error {
 }
 
 func (s *PostgresStorage) GetAccountByID(id int) (*types.Account, error) {
-	query := "select * from account where id = $1;"
+	query := "select id, firstname, lastname, password, email, role from account where id = $1;"
 	res, err := s.DB.Query(query, id)
 	if err != nil {
 		return nil, err
@@ -25,7 +26,7 @@ func (s *PostgresStorage) GetAccountByID(id int) (*types.Account, error) {
 }
 
 func (s *PostgresStorage) GetAccountByEmail(Email string) (*types.Account, error) {
-	query := "select * from account where email = $1 limit 1"
+	query := "select id, firstname, lastname, password, email, role from account where email = $1 limit 1"
 	res := s.DB.QueryRow(query, Email)
 	var account types.Account
 	err := res.Scan(account.Pointers())
@@ -38,15 +39,32 @@ func (s *PostgresStorage) UpdateAccount(account *types.Account) error {
 	return err
 }
 
-func (s *PostgresStorage) CreateUserRequest(request *types.UserRequest) error {
-	query := "Insert into user_requests (firstname, lastname, email, password, tag, expires_at) values ($1, $2, $3, $4, $5, $6);"
-	_, err := s.DB.Exec(query, request.FirstName, request.LastName, request.Email, request.Password, request.Tag, request.ExpiresAt)
+func (s *PostgresStorage) UpdateAccountPassword(account *types.Account) error {
+	query := `update account set password = $1 where id = $2;`
+	_, err := s.DB.Exec(query, account.Password, account.ID)
 	return err
 }
 
+func (s *PostgresStorage) CreateUserRequest(request *types.UserRequest, message *types.OutboxMessage) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "Insert into user_requests (firstname, lastname, email, password, tag, expires_at) values ($1, $2, $3, $4, $5, $6);"
+	if _, err = tx.Exec(query, request.FirstName, request.LastName, request.Email, request.Password, request.Tag, request.ExpiresAt); err != nil {
+		return err
+	}
+	if err = enqueueEmail(tx, message); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (s *PostgresStorage) GetUserRequestByTAG(tag string) (*types.UserRequest, error) {
-	query := "select * from user_requests where tag = $1;"
-	res, err := s.DB.Query(query, tag)
+	query := "select * from user_requests where tag = $1 and expires_at > $2;"
+	res, err := s.DB.Query(query, tag, time.Now().UTC())
 	if err != nil {
 		return nil, err
 	}
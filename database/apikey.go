@@ -0,0 +1,53 @@
+package database
+
+import (
+	"Libraria/types"
+	"fmt"
+	"time"
+)
+
+const apiKeySelect = `select id, library_id, name, prefix, scope, created_at, last_used_at, revoked_at from api_keys`
+
+func (s *PostgresStorage) CreateAPIKey(key *types.APIKey) error {
+	query := `insert into api_keys (library_id, name, prefix, key_hash, scope, created_at) values ($1, $2, $3, $4, $5, $6) returning id`
+	return s.DB.QueryRow(query, key.LibraryID, key.Name, key.Prefix, key.Hash, key.Scope, key.CreatedAt).Scan(&key.ID)
+}
+
+func (s *PostgresStorage) GetAPIKeysByLibraryID(id int) (*[]types.APIKey, error) {
+	keys := []types.APIKey{}
+	rows, err := s.DB.Query(apiKeySelect+` where library_id = $1 order by revoked_at is not null, created_at desc`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key types.APIKey
+		if err = rows.Scan(key.Pointers()); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return &keys, nil
+}
+
+// UseAPIKey looks up an active key by its hash and stamps its last use
+func (s *PostgresStorage) UseAPIKey(hash string) (*types.APIKey, error) {
+	var key types.APIKey
+	query := `update api_keys set last_used_at = $2 where key_hash = $1 and revoked_at is null
+	returning id, library_id, name, prefix, scope, created_at, last_used_at, revoked_at`
+	err := s.DB.QueryRow(query, hash, time.Now().UTC()).Scan(key.Pointers())
+	return &key, err
+}
+
+func (s *PostgresStorage) RevokeAPIKey(id, libraryID int) error {
+	query := `update api_keys set revoked_at = $3 where id = $1 and library_id = $2 and revoked_at is null`
+	res, err := s.DB.Exec(query, id, libraryID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err != nil || count == 0 {
+		return fmt.Errorf("api key not found")
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"Libraria/types"
+	"context"
 	"database/sql"
 	"fmt"
 	"github.com/joho/godotenv"
@@ -28,34 +29,107 @@ type Storage interface {
 	GetAccountByEmail(Email string) (*types.Account, error)
 	GetAccountByID(id int) (*types.Account, error)
 	UpdateAccount(account *types.Account) error
+	UpdateAccountPassword(account *types.Account) error
 	GetLibraries() (*[]types.LibraryWeb, error)
 	CreateLibraryAccount(library *types.LibraryAccount) error
 	GetLibraryByEmail(Email string) (*types.LibraryAccount, error)
 	GetLibraryByID(id int) (*types.LibraryAccount, error)
 	UpdateLibrary(account *types.LibraryAccount) error
+	UpdateLibraryPassword(account *types.LibraryAccount) error
 	GetUserRequestByTAG(tag string) (*types.UserRequest, error)
-	CreateUserRequest(request *types.UserRequest) error
+	CreateUserRequest(request *types.UserRequest, message *types.OutboxMessage) error
 	DeleteUserRequest(request *types.UserRequest) error
 
 	GetLibRequestByTAG(tag string) (*types.LibRequest, error)
-	CreateLibRequest(request *types.LibRequest) error
+	CreateLibRequest(request *types.LibRequest, message *types.OutboxMessage) error
 	DeleteLibRequest(request *types.LibRequest) error
-	ClearRequests()
-	OneTimeClear()
+	ClearExpired(ctx context.Context) error
 	CreateBook(book *types.Book) error
 	GetBooks() (*[]types.Book, error)
 	GetSomeBooks() (*[]types.Book, error)
 	GetBookByID(id int) (*types.Book, error)
 	UpdateBook(book types.Book) error
 	DeleteBookByID(id int) error
-	SearchBookName(name string) (*[]types.Book, *[]types.LibraryWeb, error)
-	CreatePasswordReset(request *types.PasswordResetRequest) error
+	SearchBooks(params *types.SearchParams) (*types.SearchResult, error)
+	Autocomplete(prefix string, limit int) (*[]types.Suggestion, error)
+	CreatePasswordReset(request *types.PasswordResetRequest, message *types.OutboxMessage) error
 	GetPasswordReset(token string) (*types.PasswordResetRequest, error)
 	DeletePasswordReset(request *types.PasswordResetRequest) error
-	GetLibrariesByBookID(id int) (*[]types.LibraryAccount, error)
-	GetBooksByLibraryID(id int) (*[]types.Book, error)
+	GetLibrariesByBookID(id int) (*[]types.LibraryHolding, error)
+	GetBooksByLibraryID(id int) (*[]types.BookHolding, error)
 	AddBookVisit(user_id, book_id int)
 	GetLastBooks(id int) (*[]types.Book, error)
+	CheckoutBook(loan *types.Loan) error
+	ReturnBook(loanID, libraryID int) (*types.Loan, error)
+	GetLoansByUserID(id int) (*[]types.Loan, error)
+	GetLoansByLibraryID(id int) (*[]types.Loan, error)
+	PlaceHold(hold *types.Hold) error
+	GetHoldByID(id int) (*types.Hold, error)
+	CancelHold(id int) (*types.Hold, error)
+	GetHoldsByUserID(id int) (*[]types.Hold, error)
+	GetHoldsByLibraryID(id int) (*[]types.Hold, error)
+	ServeHolds(bookID, libraryID uint, expiresAt time.Time) (*[]types.Hold, error)
+	ExpireHolds() (*[]types.LibraryBook, error)
+	AddLibraryBook(book *types.LibraryBook) error
+	UpdateLibraryBook(book *types.LibraryBook) error
+	DeleteLibraryBook(bookID, libraryID int) error
+	CreateItem(item *types.Item) error
+	GetItemByBarcode(barcode string) (*types.Item, error)
+	UpdateItem(item *types.Item) error
+	GetLibrarySchedule(id int) (*types.LibrarySchedule, error)
+	GetLibrarySchedules() (map[uint]*types.LibrarySchedule, error)
+	UpdateLibrarySchedule(id int, schedule *types.LibrarySchedule) error
+	CreateSession(session *types.Session) error
+	GetSessionByRefreshHash(hash string) (*types.Session, error)
+	GetSession(id string) (*types.Session, error)
+	RotateSession(id, hash string, expiresAt time.Time) error
+	RevokeSession(id string) error
+	RevokeSessions(kind string, subjectID uint) error
+	RevokeOtherSessions(kind string, subjectID uint, keepID string) error
+	IsSessionActive(id string) bool
+	TakeRateTokens(limits map[string]types.RateLimit) (time.Duration, error)
+	GetLockedUntil(email string) (*time.Time, error)
+	RecordLoginFailure(email string, lockout types.Lockout) (*time.Time, error)
+	ClearLoginFailures(email string) error
+	GetTwoFactor(kind string, subjectID uint) (*types.TwoFactor, error)
+	SaveTwoFactor(tf *types.TwoFactor) error
+	EnableTwoFactor(kind string, subjectID uint, codeHashes []string) error
+	DisableTwoFactor(kind string, subjectID uint) error
+	UseTOTPStep(kind string, subjectID uint, step int64) (bool, error)
+	UseRecoveryCode(kind string, subjectID uint, codeHash string) (bool, error)
+	CreateLoginChallenge(challenge *types.LoginChallenge) error
+	GetLoginChallenge(id string) (*types.LoginChallenge, error)
+	DeleteLoginChallenge(id string) error
+	CreateAPIKey(key *types.APIKey) error
+	GetAPIKeysByLibraryID(id int) (*[]types.APIKey, error)
+	UseAPIKey(hash string) (*types.APIKey, error)
+	RevokeAPIKey(id, libraryID int) error
+	CreateOIDCLogin(login *types.OIDCLogin) error
+	TakeOIDCLogin(state string) (*types.OIDCLogin, error)
+	GetAccountByIdentity(issuer, subject string) (*types.Account, error)
+	LinkIdentity(issuer, subject string, accountID uint) error
+	CreateEmailChange(request *types.EmailChangeRequest) error
+	GetEmailChangeByTAG(tag string) (*types.EmailChangeRequest, error)
+	ChangeEmail(request *types.EmailChangeRequest) error
+	ExportAccount(id int) (*types.AccountExport, error)
+	CreateAccountDeletion(deletion *types.AccountDeletion) error
+	GetAccountDeletionByTAG(tag string) (*types.AccountDeletion, error)
+	DeleteAccount(id uint) (*[]types.LibraryBook, error)
+	EnqueueEmail(message *types.OutboxMessage) error
+	ClaimOutbox(limit int, lease time.Duration) (*[]types.OutboxMessage, error)
+	UpdateOutboxMessage(message *types.OutboxMessage) error
+	GetOutboxMessages(status string) (*[]types.OutboxMessage, error)
+	ResendOutboxMessage(id int) error
+	GetLocale(kind string, subjectID uint) (string, error)
+	SetLocale(kind string, subjectID uint, locale string) error
+	Notified(event string, refID uint) (bool, error)
+	NotifyOnce(event string, refID uint, message *types.OutboxMessage) (bool, error)
+	GetLoansDueBetween(from, to time.Time) (*[]types.Loan, error)
+	GetReadyHolds() (*[]types.Hold, error)
+	TryJobLock(ctx context.Context, name string) (func(), bool, error)
+	LastJobRun(name string) (*time.Time, error)
+	SaveJobRun(run *types.JobRun) error
+	GetJobRuns() (*[]types.JobRun, error)
 }
 
 type PostgresStorage struct {
@@ -98,7 +172,13 @@ func (s *PostgresStorage) CheckEmail(Email string) (bool, error) {
 	for t := 0; t < len(tables); t++ {
 		var count int
 		query := "select count(*) from " + tables[t] + " where email = $1"
-		err := s.DB.QueryRow(query, Email).Scan(&count)
+		args := []any{Email}
+		// expired requests no longer hold the address, whether or not the cleanup job got to them yet
+		if strings.HasSuffix(tables[t], "_requests") {
+			query += " and expires_at > $2"
+			args = append(args, time.Now().UTC())
+		}
+		err := s.DB.QueryRow(query, args...).Scan(&count)
 		if err != nil {
 			return false, err
 		}
@@ -130,9 +210,9 @@ func (s *PostgresStorage) MakeToken(Table string) string {
 
 // ###########################################################################################
 func (s *PostgresStorage) CheckForRequest(email string) error {
-	query := "select count(*) from password_reset where email = $1"
+	query := "select count(*) from password_reset where email = $1 and expires_at > $2"
 	var count int
-	err := s.DB.QueryRow(query, email).Scan(&count)
+	err := s.DB.QueryRow(query, email, time.Now().UTC()).Scan(&count)
 	if err != nil {
 		return err
 	}
@@ -161,14 +241,14 @@ func (s *PostgresStorage) AddBookVisit(user_id, book_id int) {
 }
 
 func (s *PostgresStorage) CreateBook(book *types.Book) error {
-	query := `insert into book (name, author, year, genre, description, language, page_number) values ($1, $2, $3, $4, $5, $6);`
+	query := `insert into book (name, author, year, genre, description, language) values ($1, $2, $3, $4, $5, $6);`
 	_, err := s.DB.Exec(query, book.Name, book.Author, book.Year, book.Genre, book.Description, book.Language)
 	return err
 }
 
 func (s *PostgresStorage) GetBooks() (*[]types.Book, error) {
 	var books []types.Book
-	query := `select * from book;`
+	query := `select id, name, author, year, genre, description, language from book;`
 	rows, err := s.DB.Query(query)
 	if err != nil {
 		return nil, err
@@ -186,7 +266,7 @@ func (s *PostgresStorage) GetBooks() (*[]types.Book, error) {
 
 func (s *PostgresStorage) GetSomeBooks() (*[]types.Book, error) {
 	var books []types.Book
-	query := `select id,name,author,year,genre,description from book join 
+	query := `select id,name,author,year,genre,description,language from book join 
 (select * from (select count(library_id) as cnt, book_id from book_lib 
 				group by book_id)) on book.id = book_id order by cnt desc limit 15;`
 	rows, err := s.DB.Query(query)
@@ -208,7 +288,7 @@ func (s *PostgresStorage) GetSomeBooks() (*[]types.Book, error) {
 
 func (s *PostgresStorage) GetBookByID(id int) (*types.Book, error) {
 	var book types.Book
-	query := `select * from book where id = $1`
+	query := `select id, name, author, year, genre, description, language from book where id = $1`
 	row, err := s.DB.Query(query, id)
 	if err != nil {
 		return &book, err
@@ -218,51 +298,9 @@ func (s *PostgresStorage) GetBookByID(id int) (*types.Book, error) {
 	return &book, err
 }
 
-func (s *PostgresStorage) SearchBookName(name string) (*[]types.Book, *[]types.LibraryWeb, error) {
-	var books []types.Book
-	query := `select * from (
-select id,name,author,year,genre,description from book join 
-(select * from (select count(library_id) as cnt, book_id from book_lib 
-				group by book_id)) on book.id = book_id order by cnt desc)
-where lower(name) like $1 or lower(author) like $1 or lower(genre) like $1;`
-	name = "%" + strings.ToLower(name) + "%"
-	rows, err := s.DB.Query(query, name)
-	if err != nil {
-		return nil, nil, err
-	}
-	for rows.Next() {
-		var book types.Book
-		if err := rows.Scan(book.Pointers()); err != nil {
-			fmt.Println(err)
-			continue
-		}
-		books = append(books, book)
-	}
-	if len(books) == 0 {
-		return nil, nil, fmt.Errorf("no books found")
-	}
-	query = `select id, email, name, address, contactnumber, latitude, longitude from library join
-	(select distinct(library_id) from book_lib join (
-    	select id from book where lower(name) like $1 or lower(author) like $1 or lower(genre) like $1
-	) as sub on book_id = sub.id) as bigQuery on id = library_id;`
-	var libs []types.LibraryWeb
-	if rows, err = s.DB.Query(query, name); err != nil {
-		return &books, nil, nil
-	}
-	for rows.Next() {
-		var lib types.LibraryWeb
-		if err = rows.Scan(&lib.ID, &lib.Email, &lib.Name, &lib.Address, &lib.ContactNumber, &lib.Latitude, &lib.Longitude); err != nil {
-			fmt.Println(err)
-			continue
-		}
-		libs = append(libs, lib)
-	}
-	return &books, &libs, nil
-}
-
 func (s *PostgresStorage) GetLastBooks(id int) (*[]types.Book, error) {
 	var books []types.Book
-	query := `select * from book join (
+	query := `select id, name, author, year, genre, description, language, book_id, time from book join (
     	select distinct(book_id), time from last_books where user_id = $1
     	order by time desc limit 5 
 	) as subquery on id = book_id`
@@ -274,7 +312,7 @@ func (s *PostgresStorage) GetLastBooks(id int) (*[]types.Book, error) {
 		var book types.Book
 		var temp int
 		var tim time.Time
-		if err = row.Scan(&book.ID, &book.Name, &book.Author, &book.Year, &book.Genre, &book.Description, &temp, &tim); err != nil {
+		if err = row.Scan(&book.ID, &book.Name, &book.Author, &book.Year, &book.Genre, &book.Description, &book.Language, &temp, &tim); err != nil {
 			return nil, err
 		}
 		books = append(books, book)
@@ -285,20 +323,20 @@ func (s *PostgresStorage) GetLastBooks(id int) (*[]types.Book, error) {
 	return &books, nil
 }
 
-func (s *PostgresStorage) GetBooksByLibraryID(id int) (*[]types.Book, error) {
-	var books []types.Book
-	query := `select id, name, author, year, genre, description 
+func (s *PostgresStorage) GetBooksByLibraryID(id int) (*[]types.BookHolding, error) {
+	var books []types.BookHolding
+	query := `select id, name, author, year, genre, description, amount
 	from book join (
-		select distinct(book_id) from book_lib
-		where library_id = $1
+		select book_id, sum(amount) as amount from book_lib
+		where library_id = $1 group by book_id
 	) as sub on id = book_id;`
 	rows, err := s.DB.Query(query, id)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		var book types.Book
-		if err = rows.Scan(book.Pointers()); err != nil {
+		var book types.BookHolding
+		if err = rows.Scan(&book.ID, &book.Name, &book.Author, &book.Year, &book.Genre, &book.Description, &book.Available); err != nil {
 			continue
 		}
 		books = append(books, book)
@@ -309,20 +347,20 @@ func (s *PostgresStorage) GetBooksByLibraryID(id int) (*[]types.Book, error) {
 	return &books, nil
 }
 
-func (s *PostgresStorage) GetLibrariesByBookID(id int) (*[]types.LibraryAccount, error) {
-	var libs []types.LibraryAccount
-	query := `select id, name, email, password, address, contactnumber, latitude, longitude
+func (s *PostgresStorage) GetLibrariesByBookID(id int) (*[]types.LibraryHolding, error) {
+	var libs []types.LibraryHolding
+	query := `select id, email, name, address, contactnumber, latitude, longitude, amount
 	from library join (
-		select distinct(library_id) from book_lib 
-		where book_id = $1
+		select library_id, sum(amount) as amount from book_lib
+		where book_id = $1 group by library_id
 	) as subquery on id = library_id;`
 	rows, err := s.DB.Query(query, id)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		var lib types.LibraryAccount
-		if err = rows.Scan(lib.Pointers()); err != nil {
+		var lib types.LibraryHolding
+		if err = rows.Scan(&lib.ID, &lib.Email, &lib.Name, &lib.Address, &lib.ContactNumber, &lib.Latitude, &lib.Longitude, &lib.Available); err != nil {
 			continue
 		}
 		libs = append(libs, lib)
@@ -330,6 +368,29 @@ func (s *PostgresStorage) GetLibrariesByBookID(id int) (*[]types.LibraryAccount,
 	if len(libs) == 0 {
 		return nil, fmt.Errorf("no libraries found")
 	}
+
+	// Libraries that register individual copies also get a per-status breakdown
+	query = `select library_id, status, count(*) from items where book_id = $1 group by library_id, status`
+	if rows, err = s.DB.Query(query, id); err != nil {
+		return &libs, nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var libraryID, count uint
+		var status string
+		if err = rows.Scan(&libraryID, &status, &count); err != nil {
+			continue
+		}
+		for i := range libs {
+			if libs[i].ID != libraryID {
+				continue
+			}
+			if libs[i].Items == nil {
+				libs[i].Items = map[string]uint{}
+			}
+			libs[i].Items[status] = count
+		}
+	}
 	return &libs, nil
 }
 
@@ -345,15 +406,26 @@ func (s *PostgresStorage) UpdateBook(book types.Book) error {
 	return err
 }
 
-func (s *PostgresStorage) CreatePasswordReset(request *types.PasswordResetRequest) error {
+func (s *PostgresStorage) CreatePasswordReset(request *types.PasswordResetRequest, message *types.OutboxMessage) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `insert into password_reset (email, tag, expires_at) values ($1, $2, $3)`
-	_, err := s.DB.Exec(query, request.Email, request.Token, request.ExpiresAt)
-	return err
+	if _, err = tx.Exec(query, request.Email, request.Token, request.ExpiresAt); err != nil {
+		return err
+	}
+	if err = enqueueEmail(tx, message); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (s *PostgresStorage) GetPasswordReset(token string) (*types.PasswordResetRequest, error) {
-	query := `select * from password_reset where tag = $1 limit 1;`
-	row := s.DB.QueryRow(query, token)
+	query := `select * from password_reset where tag = $1 and expires_at > $2 limit 1;`
+	row := s.DB.QueryRow(query, token, time.Now().UTC())
 	var req types.PasswordResetRequest
 	err := row.Scan(&req.ID, &req.Email, &req.Token, &req.ExpiresAt)
 	return &req, err
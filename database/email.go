@@ -0,0 +1,59 @@
+package database
+
+import (
+	"Libraria/types"
+	"fmt"
+	"time"
+)
+
+// CreateEmailChange replaces any change still pending for the same account
+func (s *PostgresStorage) CreateEmailChange(request *types.EmailChangeRequest) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `delete from email_changes where kind = $1 and subject_id = $2`
+	if _, err = tx.Exec(query, request.Kind, request.SubjectID); err != nil {
+		return err
+	}
+	query = `insert into email_changes (kind, subject_id, old_email, email, tag, expires_at) values ($1, $2, $3, $4, $5, $6) returning id`
+	err = tx.QueryRow(query, request.Kind, request.SubjectID, request.OldEmail, request.Email, request.Tag, request.ExpiresAt).Scan(&request.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStorage) GetEmailChangeByTAG(tag string) (*types.EmailChangeRequest, error) {
+	query := `select id, kind, subject_id, old_email, email, tag, expires_at from email_changes where tag = $1 and expires_at > $2`
+	var request types.EmailChangeRequest
+	err := s.DB.QueryRow(query, tag, time.Now().UTC()).Scan(request.Pointers())
+	return &request, err
+}
+
+// ChangeEmail swaps the login address and consumes the request
+func (s *PostgresStorage) ChangeEmail(request *types.EmailChangeRequest) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `update account set email = $2 where id = $1 and email = $3`
+	if request.Kind == types.SessionLibrary {
+		query = `update library set email = $2 where id = $1 and email = $3`
+	}
+	res, err := tx.Exec(query, request.SubjectID, request.Email, request.OldEmail)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err != nil || count == 0 {
+		return fmt.Errorf("email has changed in the meantime")
+	}
+	if _, err = tx.Exec(`delete from email_changes where id = $1`, request.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
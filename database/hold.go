@@ -0,0 +1,196 @@
+package database
+
+import (
+	"Libraria/types"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"time"
+)
+
+// ErrHoldExists is returned when the patron already waits for the book at that library
+var ErrHoldExists = errors.New("hold already exists")
+
+const holdSelect = `select holds.id, holds.book_id, holds.library_id, holds.user_id, book.name, library.name, holds.status,
+	case when holds.status = 'waiting' then (
+		select count(*) from holds h where h.book_id = holds.book_id and h.library_id = holds.library_id
+		and h.status = 'waiting' and h.id <= holds.id
+	) else 0 end,
+	holds.created_at, holds.ready_at, holds.expires_at
+	from holds join book on book.id = holds.book_id join library on library.id = holds.library_id`
+
+func (s *PostgresStorage) PlaceHold(hold *types.Hold) error {
+	var count int
+	query := `select count(*) from book_lib where book_id = $1 and library_id = $2`
+	if err := s.DB.QueryRow(query, hold.BookID, hold.LibraryID).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("library does not hold this book")
+	}
+	query = `select count(*) from book_lib where book_id = $1 and library_id = $2 and amount > 0`
+	if err := s.DB.QueryRow(query, hold.BookID, hold.LibraryID).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("copies are available, no hold needed")
+	}
+	query = `select count(*) from holds where book_id = $1 and library_id = $2 and user_id = $3 and status in ('waiting', 'ready')`
+	if err := s.DB.QueryRow(query, hold.BookID, hold.LibraryID, hold.UserID).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrHoldExists
+	}
+	hold.Status = types.HoldWaiting
+	query = `insert into holds (book_id, library_id, user_id, status, created_at) values ($1, $2, $3, $4, $5) returning id`
+	err := s.DB.QueryRow(query, hold.BookID, hold.LibraryID, hold.UserID, hold.Status, hold.CreatedAt).Scan(&hold.ID)
+	// a request racing this one got its hold in first
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "holds_active_idx" {
+		return ErrHoldExists
+	}
+	return err
+}
+
+func (s *PostgresStorage) GetHoldByID(id int) (*types.Hold, error) {
+	var hold types.Hold
+	err := s.DB.QueryRow(holdSelect+` where holds.id = $1`, id).Scan(hold.Pointers())
+	return &hold, err
+}
+
+func (s *PostgresStorage) CancelHold(id int) (*types.Hold, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var hold types.Hold
+	query := `select id, book_id, library_id, user_id, status from holds where id = $1 and status in ('waiting', 'ready') for update`
+	if err = tx.QueryRow(query, id).Scan(&hold.ID, &hold.BookID, &hold.LibraryID, &hold.UserID, &hold.Status); err != nil {
+		return nil, fmt.Errorf("no active hold found")
+	}
+	if _, err = tx.Exec(`update holds set status = $2 where id = $1`, id, types.HoldCancelled); err != nil {
+		return nil, err
+	}
+	// The copy set aside for this hold goes back on the shelf
+	if hold.Status == types.HoldReady {
+		query = `update book_lib set amount = amount + 1 where book_id = $1 and library_id = $2`
+		if _, err = tx.Exec(query, hold.BookID, hold.LibraryID); err != nil {
+			return nil, err
+		}
+	}
+	return &hold, tx.Commit()
+}
+
+func (s *PostgresStorage) GetHoldsByUserID(id int) (*[]types.Hold, error) {
+	query := holdSelect + ` where holds.user_id = $1 and holds.status in ('waiting', 'ready') order by holds.created_at`
+	return s.queryHolds(query, id)
+}
+
+func (s *PostgresStorage) GetHoldsByLibraryID(id int) (*[]types.Hold, error) {
+	query := holdSelect + ` where holds.library_id = $1 and holds.status in ('waiting', 'ready')
+	order by holds.book_id, holds.created_at, holds.id`
+	return s.queryHolds(query, id)
+}
+
+// ServeHolds moves copies on the shelf to the oldest waiting holds and returns the holds that became ready
+func (s *PostgresStorage) ServeHolds(bookID, libraryID uint, expiresAt time.Time) (*[]types.Hold, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var ids []int
+	readyAt := time.Now().UTC()
+	for {
+		query := `update book_lib set amount = amount - 1 where book_id = $1 and library_id = $2 and amount > 0
+		and exists (select 1 from holds where book_id = $1 and library_id = $2 and status = 'waiting')`
+		res, err := tx.Exec(query, bookID, libraryID)
+		if err != nil {
+			return nil, err
+		}
+		if count, err := res.RowsAffected(); err != nil || count == 0 {
+			break
+		}
+		var id int
+		query = `update holds set status = $3, ready_at = $4, expires_at = $5 where id = (
+			select id from holds where book_id = $1 and library_id = $2 and status = 'waiting'
+			order by created_at, id limit 1 for update
+		) returning id`
+		if err = tx.QueryRow(query, bookID, libraryID, types.HoldReady, readyAt, expiresAt).Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	holds := []types.Hold{}
+	for _, id := range ids {
+		hold, err := s.GetHoldByID(id)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		holds = append(holds, *hold)
+	}
+	return &holds, nil
+}
+
+// ExpireHolds closes ready holds whose pickup window has passed and returns the copies they were holding
+func (s *PostgresStorage) ExpireHolds() (*[]types.LibraryBook, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `update holds set status = $1 where status = $2 and expires_at < $3 returning book_id, library_id`
+	rows, err := tx.Query(query, types.HoldExpired, types.HoldReady, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	released := map[types.LibraryBook]uint{}
+	for rows.Next() {
+		var book types.LibraryBook
+		if err = rows.Scan(&book.BookID, &book.LibraryID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		released[book]++
+	}
+	rows.Close()
+
+	books := []types.LibraryBook{}
+	for book, amount := range released {
+		query = `update book_lib set amount = amount + $3 where book_id = $1 and library_id = $2`
+		if _, err = tx.Exec(query, book.BookID, book.LibraryID, amount); err != nil {
+			return nil, err
+		}
+		book.Amount = amount
+		books = append(books, book)
+	}
+	return &books, tx.Commit()
+}
+
+func (s *PostgresStorage) queryHolds(query string, args ...any) (*[]types.Hold, error) {
+	holds := []types.Hold{}
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hold types.Hold
+		if err = rows.Scan(hold.Pointers()); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		holds = append(holds, hold)
+	}
+	return &holds, nil
+}
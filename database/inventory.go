@@ -0,0 +1,102 @@
+package database
+
+import (
+	"Libraria/types"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// errTracksCopies refuses a hand-entered count for a title whose shelf is counted from its copies
+var errTracksCopies = errors.New("copies of this book are registered by barcode, add or change the copies instead")
+
+func (s *PostgresStorage) AddLibraryBook(book *types.LibraryBook) error {
+	var count int
+	if err := s.DB.QueryRow(`select count(*) from book where id = $1`, book.BookID).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("book not found")
+	}
+	query := `select count(*) from items where book_id = $1 and library_id = $2`
+	if err := s.DB.QueryRow(query, book.BookID, book.LibraryID).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return errTracksCopies
+	}
+	query = `insert into book_lib (book_id, library_id, amount) values ($1, $2, $3)
+	on conflict (book_id, library_id) do update set amount = book_lib.amount + excluded.amount`
+	_, err := s.DB.Exec(query, book.BookID, book.LibraryID, book.Amount)
+	return err
+}
+
+// UpdateLibraryBook sets how many copies the library owns in total. book_lib.amount only counts the copies
+// on the shelf, so the change in total is applied to it and copies on loan or set aside for holds stay counted
+func (s *PostgresStorage) UpdateLibraryBook(book *types.LibraryBook) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var available uint
+	query := `select amount from book_lib where book_id = $1 and library_id = $2 for update`
+	if err = tx.QueryRow(query, book.BookID, book.LibraryID).Scan(&available); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("library does not hold this book")
+		}
+		return err
+	}
+	tracked, err := tracksCopies(tx, book.BookID, book.LibraryID)
+	if err != nil {
+		return err
+	}
+	if tracked {
+		return errTracksCopies
+	}
+	var out uint
+	query = `select (select count(*) from loans where book_id = $1 and library_id = $2 and returned_at is null) +
+	(select count(*) from holds where book_id = $1 and library_id = $2 and status = $3)`
+	if err = tx.QueryRow(query, book.BookID, book.LibraryID, types.HoldReady).Scan(&out); err != nil {
+		return err
+	}
+	if book.Amount < out {
+		return fmt.Errorf("%d copies are on loan or set aside for holds", out)
+	}
+	query = `update book_lib set amount = $3 where book_id = $1 and library_id = $2`
+	if _, err = tx.Exec(query, book.BookID, book.LibraryID, book.Amount-out); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStorage) DeleteLibraryBook(bookID, libraryID int) error {
+	var count int
+	query := `select count(*) from loans where book_id = $1 and library_id = $2 and returned_at is null`
+	if err := s.DB.QueryRow(query, bookID, libraryID).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("book has %d copies on loan", count)
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`delete from book_lib where book_id = $1 and library_id = $2`, bookID, libraryID)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err != nil || count == 0 {
+		return fmt.Errorf("library does not hold this book")
+	}
+	query = `update holds set status = $3 where book_id = $1 and library_id = $2 and status in ('waiting', 'ready')`
+	if _, err = tx.Exec(query, bookID, libraryID, types.HoldCancelled); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+	"Libraria/types"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+func (s *PostgresStorage) CreateItem(item *types.Item) error {
+	var count int
+	if err := s.DB.QueryRow(`select count(*) from items where barcode = $1`, item.Barcode).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("barcode %s is already registered", item.Barcode)
+	}
+	if err := s.DB.QueryRow(`select count(*) from book where id = $1`, item.BookID).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("book not found")
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `insert into items (book_id, library_id, barcode, condition, shelf, status, added_at)
+	values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	err = tx.QueryRow(query, item.BookID, item.LibraryID, item.Barcode, item.Condition, item.Shelf, item.Status, item.AddedAt).Scan(&item.ID)
+	if err != nil {
+		return err
+	}
+
+	query = `insert into book_lib (book_id, library_id, amount) values ($1, $2, 0) on conflict (book_id, library_id) do nothing`
+	if _, err = tx.Exec(query, item.BookID, item.LibraryID); err != nil {
+		return err
+	}
+	if err = syncAvailability(tx, item.BookID, item.LibraryID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// syncAvailability recounts the shelf of a title kept as individual copies: its available copies
+// less those set aside for ready holds. Once a title has a copy the count entered by hand no longer applies
+func syncAvailability(tx *sql.Tx, bookID, libraryID uint) error {
+	var copies, available, reserved int
+	query := `select count(*), count(*) filter (where status = $3),
+	(select count(*) from holds where book_id = $1 and library_id = $2 and status = $4)
+	from items where book_id = $1 and library_id = $2`
+	if err := tx.QueryRow(query, bookID, libraryID, types.ItemAvailable, types.HoldReady).Scan(&copies, &available, &reserved); err != nil {
+		return err
+	}
+	if copies == 0 {
+		return nil
+	}
+	if available < reserved {
+		return fmt.Errorf("copy is reserved for a hold")
+	}
+	query = `update book_lib set amount = $3 where book_id = $1 and library_id = $2`
+	_, err := tx.Exec(query, bookID, libraryID, available-reserved)
+	return err
+}
+
+// tracksCopies reports whether the shelf of a title is counted from its copies
+func tracksCopies(tx *sql.Tx, bookID, libraryID uint) (bool, error) {
+	var count int
+	query := `select count(*) from items where book_id = $1 and library_id = $2`
+	err := tx.QueryRow(query, bookID, libraryID).Scan(&count)
+	return count > 0, err
+}
+
+func (s *PostgresStorage) GetItemByBarcode(barcode string) (*types.Item, error) {
+	query := `select id, book_id, library_id, barcode, condition, shelf, status, added_at from items where barcode = $1`
+	var item types.Item
+	err := s.DB.QueryRow(query, barcode).Scan(item.Pointers())
+	return &item, err
+}
+
+func (s *PostgresStorage) UpdateItem(item *types.Item) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	query := `select status from items where id = $1 for update`
+	if err = tx.QueryRow(query, item.ID).Scan(&status); err != nil {
+		return err
+	}
+	if status == types.ItemOnLoan && item.Status != types.ItemLost {
+		return fmt.Errorf("copy is on loan, return it first")
+	}
+
+	query = `update items set condition = $2, shelf = $3, status = $4 where id = $1`
+	if _, err = tx.Exec(query, item.ID, item.Condition, item.Shelf, item.Status); err != nil {
+		return err
+	}
+
+	// A copy lost while out ends its loan, otherwise it stays overdue and a later return would shelve it again
+	if status == types.ItemOnLoan {
+		query = `update loans set returned_at = $2 where item_id = $1 and returned_at is null`
+		if _, err = tx.Exec(query, item.ID, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+
+	if err = syncAvailability(tx, item.BookID, item.LibraryID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
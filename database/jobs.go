@@ -0,0 +1,87 @@
+package database
+
+import (
+	"Libraria/types"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// jobLockClass keeps job locks apart from any other advisory lock taken on the same database
+const jobLockClass = 4201
+
+// TryJobLock takes a session level advisory lock on a dedicated connection, so only one instance runs
+// the job at a time. The lock lives as long as the connection, unlock releases both
+func (s *PostgresStorage) TryJobLock(ctx context.Context, name string) (func(), bool, error) {
+	conn, err := s.DB.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	var locked bool
+	err = conn.QueryRowContext(ctx, `select pg_try_advisory_lock($1, hashtext($2))`, jobLockClass, name).Scan(&locked)
+	if err != nil || !locked {
+		conn.Close()
+		return nil, false, err
+	}
+	unlock := func() {
+		// the job context may be cancelled by now, the lock has to be released anyway
+		_, err := conn.ExecContext(context.Background(), `select pg_advisory_unlock($1, hashtext($2))`, jobLockClass, name)
+		if err != nil {
+			fmt.Println("Error while releasing job lock", name, err)
+			// a connection still holding the lock must not go back to the pool
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}
+	return unlock, true, nil
+}
+
+// LastJobRun returns when the job last finished on any instance, nil when it never ran
+func (s *PostgresStorage) LastJobRun(name string) (*time.Time, error) {
+	var finishedAt time.Time
+	err := s.DB.QueryRow(`select finished_at from job_runs where name = $1`, name).Scan(&finishedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &finishedAt, nil
+}
+
+// SaveJobRun records the outcome of a run and adds it to the job's totals
+func (s *PostgresStorage) SaveJobRun(run *types.JobRun) error {
+	failures := 0
+	lastSuccess := &run.FinishedAt
+	if run.Error != "" {
+		failures, lastSuccess = 1, nil
+	}
+	query := `insert into job_runs (name, instance, started_at, finished_at, duration_ms, error, runs, failures, last_success_at)
+	values ($1, $2, $3, $4, $5, $6, 1, $7, $8)
+	on conflict (name) do update set instance = excluded.instance, started_at = excluded.started_at,
+	finished_at = excluded.finished_at, duration_ms = excluded.duration_ms, error = excluded.error,
+	runs = job_runs.runs + 1, failures = job_runs.failures + excluded.failures,
+	last_success_at = coalesce(excluded.last_success_at, job_runs.last_success_at)`
+	_, err := s.DB.Exec(query, run.Name, run.Instance, run.StartedAt, run.FinishedAt, run.DurationMs, run.Error, failures, lastSuccess)
+	return err
+}
+
+func (s *PostgresStorage) GetJobRuns() (*[]types.JobRun, error) {
+	rows, err := s.DB.Query(`select name, instance, started_at, finished_at, duration_ms, error, runs, failures, last_success_at from job_runs order by name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := []types.JobRun{}
+	for rows.Next() {
+		var run types.JobRun
+		if err = rows.Scan(run.Pointers()); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return &runs, rows.Err()
+}
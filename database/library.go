@@ -4,6 +4,7 @@ import (
 	"Libraria/types"
 	"database/sql"
 	"fmt"
+	"time"
 )
 
 func (s *PostgresStorage) GetLibraries() (*[]types.LibraryWeb, error) {
@@ -63,15 +64,32 @@ func (s *PostgresStorage) UpdateLibrary(account *types.LibraryAccount) error {
 	return err
 }
 
-func (s *PostgresStorage) CreateLibRequest(request *types.LibRequest) error {
-	query := "Insert into lib_requests (name, email, password, address, contactnumber, tag, expires_at) values ($1, $2, $3, $4, $5, $6, $7);"
-	_, err := s.DB.Exec(query, request.Name, request.Email, request.Password, request.Address, request.ContactNumber, request.Tag, request.ExpiresAt)
+func (s *PostgresStorage) UpdateLibraryPassword(account *types.LibraryAccount) error {
+	query := `update library set password = $1 where id = $2;`
+	_, err := s.DB.Exec(query, account.Password, account.ID)
 	return err
 }
 
+func (s *PostgresStorage) CreateLibRequest(request *types.LibRequest, message *types.OutboxMessage) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "Insert into lib_requests (name, email, password, address, contactnumber, tag, expires_at) values ($1, $2, $3, $4, $5, $6, $7);"
+	if _, err = tx.Exec(query, request.Name, request.Email, request.Password, request.Address, request.ContactNumber, request.Tag, request.ExpiresAt); err != nil {
+		return err
+	}
+	if err = enqueueEmail(tx, message); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (s *PostgresStorage) GetLibRequestByTAG(tag string) (*types.LibRequest, error) {
-	query := "select * from lib_requests where tag = $1;"
-	res, err := s.DB.Query(query, tag)
+	query := "select * from lib_requests where tag = $1 and expires_at > $2;"
+	res, err := s.DB.Query(query, tag, time.Now().UTC())
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"Libraria/types"
+	"fmt"
+	"time"
+)
+
+const loanSelect = `select loans.id, loans.book_id, loans.library_id, loans.user_id, loans.item_id, book.name, library.name,
+	loans.issued_at, loans.due_at, loans.returned_at
+	from loans join book on book.id = loans.book_id join library on library.id = loans.library_id`
+
+func (s *PostgresStorage) CheckoutBook(loan *types.Loan) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// A copy set aside for the patron's hold is already off the shelf
+	query := `update holds set status = $4 where book_id = $1 and library_id = $2 and user_id = $3 and status = $5`
+	res, err := tx.Exec(query, loan.BookID, loan.LibraryID, loan.UserID, types.HoldFulfilled, types.HoldReady)
+	if err != nil {
+		return err
+	}
+	if loan.ItemID == 0 {
+		tracked, err := tracksCopies(tx, loan.BookID, loan.LibraryID)
+		if err != nil {
+			return err
+		}
+		if tracked {
+			return fmt.Errorf("scan the barcode of the copy being lent")
+		}
+	}
+	if count, err := res.RowsAffected(); err != nil || count == 0 {
+		query = `update book_lib set amount = amount - 1 where book_id = $1 and library_id = $2 and amount > 0`
+		res, err = tx.Exec(query, loan.BookID, loan.LibraryID)
+		if err != nil {
+			return err
+		}
+		if count, err := res.RowsAffected(); err != nil || count == 0 {
+			return fmt.Errorf("no copies available")
+		}
+	}
+
+	if loan.ItemID != 0 {
+		query = `update items set status = $3 where id = $1 and library_id = $2 and status = $4`
+		res, err = tx.Exec(query, loan.ItemID, loan.LibraryID, types.ItemOnLoan, types.ItemAvailable)
+		if err != nil {
+			return err
+		}
+		if count, err := res.RowsAffected(); err != nil || count == 0 {
+			return fmt.Errorf("copy is not available")
+		}
+	}
+
+	query = `insert into loans (book_id, library_id, user_id, item_id, issued_at, due_at) values ($1, $2, $3, $4, $5, $6) returning id`
+	if err = tx.QueryRow(query, loan.BookID, loan.LibraryID, loan.UserID, loan.ItemID, loan.IssuedAt, loan.DueAt).Scan(&loan.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStorage) ReturnBook(loanID, libraryID int) (*types.Loan, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var loan types.Loan
+	returnedAt := time.Now().UTC()
+	query := `update loans set returned_at = $3 where id = $1 and library_id = $2 and returned_at is null
+	returning id, book_id, library_id, user_id, item_id, issued_at, due_at, returned_at`
+	err = tx.QueryRow(query, loanID, libraryID, returnedAt).Scan(&loan.ID, &loan.BookID, &loan.LibraryID, &loan.UserID, &loan.ItemID, &loan.IssuedAt, &loan.DueAt, &loan.ReturnedAt)
+	if err != nil {
+		return nil, fmt.Errorf("no active loan found")
+	}
+
+	if loan.ItemID != 0 {
+		query = `update items set status = $2 where id = $1 and status = $3`
+		res, err := tx.Exec(query, loan.ItemID, types.ItemAvailable, types.ItemOnLoan)
+		if err != nil {
+			return nil, err
+		}
+		// the copy was marked lost or withdrawn meanwhile, it does not go back on the shelf
+		if count, err := res.RowsAffected(); err != nil || count == 0 {
+			return &loan, tx.Commit()
+		}
+	}
+
+	query = `update book_lib set amount = amount + 1 where book_id = $1 and library_id = $2`
+	if _, err = tx.Exec(query, loan.BookID, loan.LibraryID); err != nil {
+		return nil, err
+	}
+	// a loan from before the title got copies brings back no copy of its own
+	if err = syncAvailability(tx, loan.BookID, loan.LibraryID); err != nil {
+		return nil, err
+	}
+	return &loan, tx.Commit()
+}
+
+func (s *PostgresStorage) GetLoansByUserID(id int) (*[]types.Loan, error) {
+	query := loanSelect + ` where loans.user_id = $1 order by loans.returned_at is not null, loans.due_at`
+	return s.queryLoans(query, id)
+}
+
+func (s *PostgresStorage) GetLoansByLibraryID(id int) (*[]types.Loan, error) {
+	query := loanSelect + ` where loans.library_id = $1 and loans.returned_at is null order by loans.due_at`
+	return s.queryLoans(query, id)
+}
+
+func (s *PostgresStorage) queryLoans(query string, args ...any) (*[]types.Loan, error) {
+	loans := []types.Loan{}
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var loan types.Loan
+		if err = rows.Scan(loan.Pointers()); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		loans = append(loans, loan)
+	}
+	return &loans, nil
+}
@@ -0,0 +1,15 @@
+package database
+
+// GetLocale returns the language picked in settings, empty when none was saved
+func (s *PostgresStorage) GetLocale(kind string, subjectID uint) (string, error) {
+	var locale string
+	err := s.DB.QueryRow(`select locale from user_locales where kind = $1 and subject_id = $2`, kind, subjectID).Scan(&locale)
+	return locale, err
+}
+
+func (s *PostgresStorage) SetLocale(kind string, subjectID uint, locale string) error {
+	query := `insert into user_locales (kind, subject_id, locale) values ($1, $2, $3)
+	on conflict (kind, subject_id) do update set locale = excluded.locale`
+	_, err := s.DB.Exec(query, kind, subjectID, locale)
+	return err
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"Libraria/types"
+	"time"
+)
+
+// Notified tells whether the event was already recorded, so callers can skip rendering a message
+func (s *PostgresStorage) Notified(event string, refID uint) (bool, error) {
+	var exists bool
+	err := s.DB.QueryRow(`select exists(select 1 from notifications where event = $1 and ref_id = $2)`, event, refID).Scan(&exists)
+	return exists, err
+}
+
+// NotifyOnce records the event and queues its email in one transaction,
+// false means the event had already been recorded and nothing was queued
+func (s *PostgresStorage) NotifyOnce(event string, refID uint, message *types.OutboxMessage) (bool, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := `insert into notifications (event, ref_id, created_at) values ($1, $2, $3) on conflict do nothing`
+	res, err := tx.Exec(query, event, refID, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	if count, err := res.RowsAffected(); err != nil || count == 0 {
+		return false, err
+	}
+	if err = enqueueEmail(tx, message); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// GetLoansDueBetween returns loans still out whose due date falls in (from, to]
+func (s *PostgresStorage) GetLoansDueBetween(from, to time.Time) (*[]types.Loan, error) {
+	query := loanSelect + ` where loans.returned_at is null and loans.user_id <> 0 and loans.due_at > $1 and loans.due_at <= $2 order by loans.due_at`
+	return s.queryLoans(query, from, to)
+}
+
+func (s *PostgresStorage) GetReadyHolds() (*[]types.Hold, error) {
+	return s.queryHolds(holdSelect+` where holds.status = $1 order by holds.ready_at`, types.HoldReady)
+}
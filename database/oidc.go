@@ -0,0 +1,36 @@
+package database
+
+import (
+	"Libraria/types"
+	"time"
+)
+
+func (s *PostgresStorage) CreateOIDCLogin(login *types.OIDCLogin) error {
+	query := `insert into oidc_logins (state, verifier, nonce, expires_at) values ($1, $2, $3, $4)`
+	_, err := s.DB.Exec(query, login.State, login.Verifier, login.Nonce, login.ExpiresAt)
+	return err
+}
+
+// TakeOIDCLogin removes the login as it is read, a state can only be redeemed once
+func (s *PostgresStorage) TakeOIDCLogin(state string) (*types.OIDCLogin, error) {
+	var login types.OIDCLogin
+	query := `delete from oidc_logins where state = $1 and expires_at > $2 returning state, verifier, nonce, expires_at`
+	err := s.DB.QueryRow(query, state, time.Now().UTC()).Scan(&login.State, &login.Verifier, &login.Nonce, &login.ExpiresAt)
+	return &login, err
+}
+
+func (s *PostgresStorage) GetAccountByIdentity(issuer, subject string) (*types.Account, error) {
+	query := `select account.id, account.firstname, account.lastname, account.password, account.email, account.role
+	from account join account_identities on account_identities.account_id = account.id
+	where account_identities.issuer = $1 and account_identities.subject = $2`
+	var account types.Account
+	err := s.DB.QueryRow(query, issuer, subject).Scan(account.Pointers())
+	return &account, err
+}
+
+func (s *PostgresStorage) LinkIdentity(issuer, subject string, accountID uint) error {
+	query := `insert into account_identities (issuer, subject, account_id, created_at) values ($1, $2, $3, $4)
+	on conflict (issuer, subject) do nothing`
+	_, err := s.DB.Exec(query, issuer, subject, accountID, time.Now().UTC())
+	return err
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"Libraria/types"
+	"database/sql"
+	"time"
+)
+
+// enqueueEmail stores a message inside the caller's transaction, so it exists exactly when the row it refers to does
+func enqueueEmail(tx *sql.Tx, message *types.OutboxMessage) error {
+	now := time.Now().UTC()
+	message.Status = types.OutboxPending
+	message.CreatedAt = now
+	message.NextAttemptAt = now
+	query := `insert into email_outbox (recipient, subject, body, html, status, next_attempt_at, created_at, expires_at, locale)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+	return tx.QueryRow(query, message.Recipient, message.Subject, message.Body, message.HTML, message.Status, message.NextAttemptAt, message.CreatedAt, message.ExpiresAt, message.Locale).Scan(&message.ID)
+}
+
+func (s *PostgresStorage) EnqueueEmail(message *types.OutboxMessage) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = enqueueEmail(tx, message); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClaimOutbox picks due messages and pushes their next attempt forward by lease,
+// so another instance polling at the same time skips them while they are being sent
+func (s *PostgresStorage) ClaimOutbox(limit int, lease time.Duration) (*[]types.OutboxMessage, error) {
+	now := time.Now().UTC()
+	query := `update email_outbox set next_attempt_at = $1 where id in (
+		select id from email_outbox where status = $2 and next_attempt_at <= $3 order by next_attempt_at limit $4 for update skip locked
+	) returning id, recipient, subject, body, html, status, attempts, next_attempt_at, last_error, created_at, sent_at, expires_at, locale`
+	rows, err := s.DB.Query(query, now.Add(lease), types.OutboxPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanOutbox(rows)
+}
+
+// UpdateOutboxMessage stores the outcome of a delivery attempt
+func (s *PostgresStorage) UpdateOutboxMessage(message *types.OutboxMessage) error {
+	query := `update email_outbox set status = $1, attempts = $2, next_attempt_at = $3, last_error = $4, sent_at = $5 where id = $6`
+	_, err := s.DB.Exec(query, message.Status, message.Attempts, message.NextAttemptAt, message.LastError, message.SentAt, message.ID)
+	return err
+}
+
+func (s *PostgresStorage) GetOutboxMessages(status string) (*[]types.OutboxMessage, error) {
+	// the listing is for admins, bodies hold links that sign in as the recipient so they are left out
+	query := `select id, recipient, subject, '', '', status, attempts, next_attempt_at, last_error, created_at, sent_at, expires_at, locale
+	from email_outbox where status = $1 order by created_at desc limit 100`
+	rows, err := s.DB.Query(query, status)
+	if err != nil {
+		return nil, err
+	}
+	return scanOutbox(rows)
+}
+
+// ResendOutboxMessage puts a dead message back in the queue with a fresh attempt budget,
+// a message whose link has expired stays dead since resending it would only deliver a broken link
+func (s *PostgresStorage) ResendOutboxMessage(id int) error {
+	now := time.Now().UTC()
+	query := `update email_outbox set status = $1, attempts = 0, next_attempt_at = $2, last_error = ''
+	where id = $3 and status = $4 and (expires_at is null or expires_at > $2)`
+	res, err := s.DB.Exec(query, types.OutboxPending, now, id, types.OutboxDead)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func scanOutbox(rows *sql.Rows) (*[]types.OutboxMessage, error) {
+	defer rows.Close()
+	messages := []types.OutboxMessage{}
+	for rows.Next() {
+		var message types.OutboxMessage
+		if err := rows.Scan(message.Pointers()); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return &messages, rows.Err()
+}
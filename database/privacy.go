@@ -0,0 +1,249 @@
+package database
+
+import (
+	"Libraria/types"
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ExportAccount gathers every row kept about an account. The reads share one repeatable read
+// transaction, so the export is a single snapshot even while the account keeps being used.
+// Secrets come back as stored, callers handing the export out Redact it first
+func (s *PostgresStorage) ExportAccount(id int) (*types.AccountExport, error) {
+	tx, err := s.DB.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var account types.Account
+	query := `select id, firstname, lastname, password, email, role from account where id = $1`
+	if err = tx.QueryRow(query, id).Scan(account.Pointers()); err != nil {
+		return nil, err
+	}
+	export := &types.AccountExport{
+		ExportedAt:   time.Now().UTC(),
+		Account:      account,
+		LastBooks:    []types.BookVisit{},
+		Loans:        []types.Loan{},
+		Holds:        []types.Hold{},
+		Sessions:     []types.Session{},
+		Identities:   []types.LinkedIdentity{},
+		EmailChanges: []types.EmailChangeRequest{},
+		Emails:       []types.OutboxMessage{},
+	}
+
+	err = scanEach(tx, func(rows *sql.Rows) error {
+		var visit types.BookVisit
+		if err := rows.Scan(&visit.BookID, &visit.BookName, &visit.Time); err != nil {
+			return err
+		}
+		export.LastBooks = append(export.LastBooks, visit)
+		return nil
+	}, `select last_books.book_id, book.name, last_books.time from last_books
+	join book on book.id = last_books.book_id where last_books.user_id = $1 order by last_books.time desc`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanEach(tx, func(rows *sql.Rows) error {
+		var loan types.Loan
+		if err := rows.Scan(loan.Pointers()); err != nil {
+			return err
+		}
+		export.Loans = append(export.Loans, loan)
+		return nil
+	}, loanSelect+` where loans.user_id = $1 order by loans.returned_at is not null, loans.due_at`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanEach(tx, func(rows *sql.Rows) error {
+		var hold types.Hold
+		if err := rows.Scan(hold.Pointers()); err != nil {
+			return err
+		}
+		export.Holds = append(export.Holds, hold)
+		return nil
+	}, holdSelect+` where holds.user_id = $1 order by holds.created_at`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanEach(tx, func(rows *sql.Rows) error {
+		var session types.Session
+		if err := rows.Scan(session.Pointers()); err != nil {
+			return err
+		}
+		export.Sessions = append(export.Sessions, session)
+		return nil
+	}, `select id, kind, subject_id, refresh_hash, previous_hash, created_at, expires_at, rotated_at, revoked_at
+	from sessions where kind = $1 and subject_id = $2 order by created_at`, types.SessionAccount, id)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `select count(*) > 0 from two_factor where kind = $1 and subject_id = $2 and enabled`
+	if err = tx.QueryRow(query, types.SessionAccount, id).Scan(&export.TwoFactorEnabled); err != nil {
+		return nil, err
+	}
+
+	query = `select coalesce((select locale from user_locales where kind = $1 and subject_id = $2), '')`
+	if err = tx.QueryRow(query, types.SessionAccount, id).Scan(&export.Locale); err != nil {
+		return nil, err
+	}
+
+	err = scanEach(tx, func(rows *sql.Rows) error {
+		var identity types.LinkedIdentity
+		if err := rows.Scan(&identity.Issuer, &identity.Subject, &identity.CreatedAt); err != nil {
+			return err
+		}
+		export.Identities = append(export.Identities, identity)
+		return nil
+	}, `select issuer, subject, created_at from account_identities where account_id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanEach(tx, func(rows *sql.Rows) error {
+		var change types.EmailChangeRequest
+		if err := rows.Scan(change.Pointers()); err != nil {
+			return err
+		}
+		export.EmailChanges = append(export.EmailChanges, change)
+		return nil
+	}, `select id, kind, subject_id, old_email, email, tag, expires_at from email_changes
+	where kind = $1 and subject_id = $2`, types.SessionAccount, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// bodies are left out like in the admin listing, they may still carry live links
+	err = scanEach(tx, func(rows *sql.Rows) error {
+		var message types.OutboxMessage
+		if err := rows.Scan(message.Pointers()); err != nil {
+			return err
+		}
+		export.Emails = append(export.Emails, message)
+		return nil
+	}, `select id, recipient, subject, '', '', status, attempts, next_attempt_at, last_error, created_at, sent_at, expires_at, locale
+	from email_outbox where `+outboxRecipient+` order by created_at`, account.Email, types.SessionAccount, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return export, tx.Commit()
+}
+
+// scanEach runs the query inside tx and hands every row to scan
+func scanEach(tx *sql.Tx, scan func(rows *sql.Rows) error, query string, args ...any) error {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// CreateAccountDeletion replaces any deletion still waiting for confirmation
+func (s *PostgresStorage) CreateAccountDeletion(deletion *types.AccountDeletion) error {
+	if _, err := s.DB.Exec(`delete from account_deletions where account_id = $1`, deletion.AccountID); err != nil {
+		return err
+	}
+	query := `insert into account_deletions (account_id, tag, expires_at) values ($1, $2, $3) returning id`
+	return s.DB.QueryRow(query, deletion.AccountID, deletion.Tag, deletion.ExpiresAt).Scan(&deletion.ID)
+}
+
+func (s *PostgresStorage) GetAccountDeletionByTAG(tag string) (*types.AccountDeletion, error) {
+	var deletion types.AccountDeletion
+	query := `select id, account_id, tag, expires_at from account_deletions where tag = $1 and expires_at > $2`
+	err := s.DB.QueryRow(query, tag, time.Now().UTC()).Scan(&deletion.ID, &deletion.AccountID, &deletion.Tag, &deletion.ExpiresAt)
+	return &deletion, err
+}
+
+// outboxRecipient matches the outbox rows addressed to an account, $1 is its email, $2 and $3 its kind and id
+// so mail sent to an address from a pending email change is found as well
+const outboxRecipient = `(recipient = $1 or recipient in (select old_email from email_changes where kind = $2 and subject_id = $3
+	union select email from email_changes where kind = $2 and subject_id = $3))`
+
+// DeleteAccount removes the account and everything tied to it in one transaction. Loan history stays with
+// the libraries but loses its owner, copies set aside for the account's holds are returned to the shelf
+func (s *PostgresStorage) DeleteAccount(id uint) (*[]types.LibraryBook, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var email string
+	if err = tx.QueryRow(`select email from account where id = $1 for update`, id).Scan(&email); err != nil {
+		return nil, err
+	}
+	var active int
+	if err = tx.QueryRow(`select count(*) from loans where user_id = $1 and returned_at is null`, id).Scan(&active); err != nil {
+		return nil, err
+	}
+	if active > 0 {
+		return nil, fmt.Errorf("please return the %d borrowed books before deleting the account", active)
+	}
+
+	rows, err := tx.Query(`delete from holds where user_id = $1 returning book_id, library_id, status`, id)
+	if err != nil {
+		return nil, err
+	}
+	released := map[types.LibraryBook]uint{}
+	for rows.Next() {
+		var book types.LibraryBook
+		var status string
+		if err = rows.Scan(&book.BookID, &book.LibraryID, &status); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if status == types.HoldReady {
+			released[book]++
+		}
+	}
+	rows.Close()
+	books := []types.LibraryBook{}
+	for book, amount := range released {
+		query := `update book_lib set amount = amount + $3 where book_id = $1 and library_id = $2`
+		if _, err = tx.Exec(query, book.BookID, book.LibraryID, amount); err != nil {
+			return nil, err
+		}
+		book.Amount = amount
+		books = append(books, book)
+	}
+
+	queries := []struct {
+		query string
+		args  []any
+	}{
+		{`update loans set user_id = 0 where user_id = $1`, []any{id}},
+		{`delete from last_books where user_id = $1`, []any{id}},
+		{`delete from sessions where kind = $1 and subject_id = $2`, []any{types.SessionAccount, id}},
+		{`delete from two_factor where kind = $1 and subject_id = $2`, []any{types.SessionAccount, id}},
+		{`delete from user_locales where kind = $1 and subject_id = $2`, []any{types.SessionAccount, id}},
+		{`delete from recovery_codes where kind = $1 and subject_id = $2`, []any{types.SessionAccount, id}},
+		{`delete from login_challenges where kind = $1 and subject_id = $2`, []any{types.SessionAccount, id}},
+		{`delete from email_outbox where ` + outboxRecipient, []any{email, types.SessionAccount, id}},
+		{`delete from email_changes where kind = $1 and subject_id = $2`, []any{types.SessionAccount, id}},
+		{`delete from account_identities where account_id = $1`, []any{id}},
+		{`delete from account_deletions where account_id = $1`, []any{id}},
+		{`delete from login_failures where email = $1`, []any{email}},
+		{`delete from password_reset where email = $1`, []any{email}},
+		{`delete from account where id = $1`, []any{id}},
+	}
+	for _, q := range queries {
+		if _, err = tx.Exec(q.query, q.args...); err != nil {
+			return nil, err
+		}
+	}
+	return &books, tx.Commit()
+}
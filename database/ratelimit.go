@@ -0,0 +1,93 @@
+package database
+
+import (
+	"Libraria/types"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+// TakeRateTokens is the token bucket shared by every instance, the row locks serialise concurrent takes.
+// Tokens are taken from all buckets or, when one of them is empty, from none
+func (s *PostgresStorage) TakeRateTokens(limits map[string]types.RateLimit) (time.Duration, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// rows are locked in key order so that two requests sharing buckets can not deadlock
+	keys := make([]string, 0, len(limits))
+	for key := range limits {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := time.Now().UTC()
+	tokens := map[string]float64{}
+	var wait time.Duration
+	for _, key := range keys {
+		limit := limits[key]
+		query := `insert into rate_limits (key, tokens, updated_at) values ($1, $2, $3) on conflict (key) do nothing`
+		if _, err = tx.Exec(query, key, limit.Burst, now); err != nil {
+			return 0, err
+		}
+		var left float64
+		var updatedAt time.Time
+		query = `select tokens, updated_at from rate_limits where key = $1 for update`
+		if err = tx.QueryRow(query, key).Scan(&left, &updatedAt); err != nil {
+			return 0, err
+		}
+		tokens[key] = limit.Refill(left, now.Sub(updatedAt))
+		wait = max(wait, limit.Wait(tokens[key]))
+	}
+	for _, key := range keys {
+		if wait == 0 {
+			tokens[key]--
+		}
+		query := `update rate_limits set tokens = $2, updated_at = $3 where key = $1`
+		if _, err = tx.Exec(query, key, tokens[key], now); err != nil {
+			return 0, err
+		}
+	}
+	return wait, tx.Commit()
+}
+
+func (s *PostgresStorage) GetLockedUntil(email string) (*time.Time, error) {
+	var lockedUntil *time.Time
+	query := `select locked_until from login_failures where email = $1 and locked_until > $2`
+	err := s.DB.QueryRow(query, email, time.Now().UTC()).Scan(&lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return lockedUntil, err
+}
+
+// RecordLoginFailure counts a failed login and returns the end of the lockout once the limit is reached
+func (s *PostgresStorage) RecordLoginFailure(email string, lockout types.Lockout) (*time.Time, error) {
+	now := time.Now().UTC()
+	query := `insert into login_failures (email, failures, first_failed_at) values ($1, 1, $2)
+	on conflict (email) do update set
+		failures = case when login_failures.first_failed_at < $3 then 1 else login_failures.failures + 1 end,
+		first_failed_at = case when login_failures.first_failed_at < $3 then $2 else login_failures.first_failed_at end
+	returning failures`
+	var failures int
+	if err := s.DB.QueryRow(query, email, now, now.Add(-lockout.Window)).Scan(&failures); err != nil {
+		return nil, err
+	}
+	if failures < lockout.MaxFailures {
+		return nil, nil
+	}
+	lockedUntil := now.Add(lockout.Duration)
+	query = `update login_failures set failures = 0, first_failed_at = $2, locked_until = $3 where email = $1`
+	if _, err := s.DB.Exec(query, email, now, lockedUntil); err != nil {
+		return nil, err
+	}
+	return &lockedUntil, nil
+}
+
+func (s *PostgresStorage) ClearLoginFailures(email string) error {
+	_, err := s.DB.Exec(`delete from login_failures where email = $1`, email)
+	return err
+}
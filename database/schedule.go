@@ -0,0 +1,98 @@
+package database
+
+import (
+	"Libraria/types"
+	"time"
+)
+
+func (s *PostgresStorage) GetLibrarySchedule(id int) (*types.LibrarySchedule, error) {
+	schedules, err := s.querySchedules(`where library_id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if schedule, ok := schedules[uint(id)]; ok {
+		return schedule, nil
+	}
+	return &types.LibrarySchedule{Weekly: []types.OpeningHours{}, Exceptions: []types.ScheduleException{}}, nil
+}
+
+func (s *PostgresStorage) GetLibrarySchedules() (map[uint]*types.LibrarySchedule, error) {
+	return s.querySchedules(``)
+}
+
+func (s *PostgresStorage) UpdateLibrarySchedule(id int, schedule *types.LibrarySchedule) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`delete from library_hours where library_id = $1`, id); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`delete from library_exceptions where library_id = $1`, id); err != nil {
+		return err
+	}
+	for _, hours := range schedule.Weekly {
+		query := `insert into library_hours (library_id, weekday, opens, closes) values ($1, $2, $3, $4)`
+		if _, err = tx.Exec(query, id, hours.Weekday, hours.Opens, hours.Closes); err != nil {
+			return err
+		}
+	}
+	for _, exception := range schedule.Exceptions {
+		query := `insert into library_exceptions (library_id, date, closed, opens, closes, note) values ($1, $2, $3, $4, $5, $6)`
+		if _, err = tx.Exec(query, id, exception.Date, exception.Closed, exception.Opens, exception.Closes, exception.Note); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStorage) querySchedules(where string, args ...any) (map[uint]*types.LibrarySchedule, error) {
+	schedules := map[uint]*types.LibrarySchedule{}
+	get := func(id uint) *types.LibrarySchedule {
+		if _, ok := schedules[id]; !ok {
+			schedules[id] = &types.LibrarySchedule{Weekly: []types.OpeningHours{}, Exceptions: []types.ScheduleException{}}
+		}
+		return schedules[id]
+	}
+
+	rows, err := s.DB.Query(`select library_id, weekday, opens, closes from library_hours `+where+` order by weekday`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id uint
+		var hours types.OpeningHours
+		if err = rows.Scan(&id, &hours.Weekday, &hours.Opens, &hours.Closes); err != nil {
+			return nil, err
+		}
+		schedule := get(id)
+		schedule.Weekly = append(schedule.Weekly, hours)
+	}
+
+	// Past exceptions no longer affect anything
+	if where == "" {
+		where = `where date >= $1`
+	} else {
+		where += ` and date >= $2`
+	}
+	args = append(args, time.Now().AddDate(0, 0, -1).Format("2006-01-02"))
+	query := `select library_id, to_char(date, 'YYYY-MM-DD'), closed, opens, closes, note from library_exceptions ` + where + ` order by date`
+	exRows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer exRows.Close()
+	for exRows.Next() {
+		var id uint
+		var exception types.ScheduleException
+		if err = exRows.Scan(&id, &exception.Date, &exception.Closed, &exception.Opens, &exception.Closes, &exception.Note); err != nil {
+			return nil, err
+		}
+		schedule := get(id)
+		schedule.Exceptions = append(schedule.Exceptions, exception)
+	}
+	return schedules, nil
+}
@@ -0,0 +1,279 @@
+package database
+
+import (
+	"Libraria/types"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// bookDocument is the weighted text searched by the book full-text index
+const bookDocument = `(setweight(to_tsvector('simple', coalesce(book.name, '')), 'A') ||
+	setweight(to_tsvector('simple', coalesce(book.author, '')), 'A') ||
+	setweight(to_tsvector('simple', coalesce(book.genre, '')), 'B') ||
+	setweight(to_tsvector('simple', coalesce(book.description, '')), 'C'))`
+
+// buildTSQuery turns user input into a to_tsquery expression: quoted parts become
+// phrases, words ending with * become prefixes and everything else is AND-ed
+func buildTSQuery(input string) string {
+	var terms []string
+	parts := strings.Split(input, `"`)
+	for i, part := range parts {
+		words := splitWords(part)
+		if len(words) == 0 {
+			continue
+		}
+		if i%2 == 1 {
+			terms = append(terms, "("+strings.Join(words, " <-> ")+")")
+			continue
+		}
+		terms = append(terms, words...)
+	}
+	return strings.Join(terms, " & ")
+}
+
+// plainText is the input without search syntax, used for trigram matching
+func plainText(input string) string {
+	words := splitWords(strings.ReplaceAll(input, `"`, " "))
+	for i := range words {
+		words[i] = strings.TrimSuffix(words[i], ":*")
+	}
+	return strings.Join(words, " ")
+}
+
+// splitWords lowercases s and breaks it into words. Punctuation, tsquery operators included, separates
+// words like the text search parser does, so "sci-fi" is searched as sci and fi
+func splitWords(s string) []string {
+	var words []string
+	for _, field := range strings.Fields(strings.ToLower(s)) {
+		parts := strings.FieldsFunc(field, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r)
+		})
+		if len(parts) == 0 {
+			continue
+		}
+		if strings.HasSuffix(field, "*") {
+			parts[len(parts)-1] += ":*"
+		}
+		words = append(words, parts...)
+	}
+	return words
+}
+
+// bookFilter collects the where clause of a search and its positional arguments
+type bookFilter struct {
+	conds   []string
+	args    []any
+	tsquery string
+	text    string
+}
+
+func (f *bookFilter) arg(v any) string {
+	f.args = append(f.args, v)
+	return fmt.Sprintf("$%d", len(f.args))
+}
+
+func (f *bookFilter) where() string {
+	if len(f.conds) == 0 {
+		return " where true"
+	}
+	return " where " + strings.Join(f.conds, " and ")
+}
+
+func newBookFilter(params *types.SearchParams) *bookFilter {
+	f := &bookFilter{}
+	if tsquery := buildTSQuery(params.Input); tsquery != "" {
+		f.tsquery = f.arg(tsquery)
+		f.text = f.arg(plainText(params.Input))
+		// Trigram word similarity catches misspelled titles and authors the text index misses
+		f.conds = append(f.conds, `(`+bookDocument+` @@ to_tsquery('simple', `+f.tsquery+`)
+		or `+f.text+` <% lower(book.name) or `+f.text+` <% lower(book.author))`)
+	}
+	if params.Genre != "" {
+		f.conds = append(f.conds, `lower(book.genre) = lower(`+f.arg(params.Genre)+`)`)
+	}
+	if params.Language != "" {
+		f.conds = append(f.conds, `lower(book.language) = lower(`+f.arg(params.Language)+`)`)
+	}
+	if params.Author != "" {
+		f.conds = append(f.conds, `lower(book.author) = lower(`+f.arg(params.Author)+`)`)
+	}
+	if params.YearFrom > 0 {
+		f.conds = append(f.conds, `book.year >= `+f.arg(params.YearFrom))
+	}
+	if params.YearTo > 0 {
+		f.conds = append(f.conds, `book.year <= `+f.arg(params.YearTo))
+	}
+	if params.LibraryID > 0 {
+		f.conds = append(f.conds, `exists (select 1 from book_lib where book_lib.book_id = book.id and book_lib.library_id = `+f.arg(params.LibraryID)+`)`)
+	}
+	return f
+}
+
+func (f *bookFilter) orderBy(sort string) string {
+	popularity := `coalesce(popularity.cnt, 0) desc`
+	switch sort {
+	case "year":
+		return ` order by book.year desc, book.id`
+	case "title":
+		return ` order by lower(book.name), book.id`
+	case "popularity":
+		return ` order by ` + popularity + `, book.id`
+	}
+	if f.tsquery == "" {
+		return ` order by ` + popularity + `, book.id`
+	}
+	return ` order by ts_rank_cd(` + bookDocument + `, to_tsquery('simple', ` + f.tsquery + `))
+	+ greatest(word_similarity(` + f.text + `, lower(book.name)), word_similarity(` + f.text + `, lower(book.author))) desc, ` + popularity + `, book.id`
+}
+
+func (s *PostgresStorage) SearchBooks(params *types.SearchParams) (*types.SearchResult, error) {
+	result := &types.SearchResult{
+		Books:     []types.Book{},
+		Libraries: []types.LibraryWeb{},
+		Facets:    map[string][]types.FacetCount{},
+		Limit:     params.Limit,
+		Offset:    params.Offset,
+	}
+	f := newBookFilter(params)
+	if err := s.DB.QueryRow(`select count(*) from book`+f.where(), f.args...).Scan(&result.Total); err != nil {
+		return nil, err
+	}
+	if f.text != "" {
+		suggestions, err := s.suggest(plainText(params.Input))
+		if err != nil {
+			fmt.Println("Error while suggesting:", err)
+		}
+		result.Suggestions = suggestions
+	}
+	if result.Total == 0 {
+		return result, nil
+	}
+
+	query := `select book.id, book.name, book.author, book.year, book.genre, book.description, book.language from book
+	left join (select count(library_id) as cnt, book_id from book_lib group by book_id) as popularity on popularity.book_id = book.id` +
+		f.where() + f.orderBy(params.Sort) + fmt.Sprintf(" limit %d offset %d", params.Limit, params.Offset)
+	rows, err := s.DB.Query(query, f.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var book types.Book
+		if err := rows.Scan(book.Pointers()); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		result.Books = append(result.Books, book)
+	}
+
+	for name, column := range map[string]string{"genre": "book.genre", "language": "book.language", "author": "book.author", "year": "book.year::text"} {
+		query = `select ` + column + `, count(*) from book` + f.where() + ` and ` + column + ` <> '' group by ` + column + ` order by count(*) desc limit 20`
+		facets, err := s.queryFacets(query, false, f.args...)
+		if err != nil {
+			fmt.Println("Error while counting facet", name, err)
+			continue
+		}
+		result.Facets[name] = facets
+	}
+	query = `select library.id, library.name, count(distinct book.id) from book
+	join book_lib on book_lib.book_id = book.id join library on library.id = book_lib.library_id` +
+		f.where() + ` group by library.id, library.name order by count(distinct book.id) desc limit 20`
+	if facets, err := s.queryFacets(query, true, f.args...); err == nil {
+		result.Facets["library"] = facets
+	} else {
+		fmt.Println("Error while counting facet library", err)
+	}
+
+	query = `select id, email, name, address, contactnumber, latitude, longitude from library
+	where id in (select library_id from book_lib where book_id in (select book.id from book` + f.where() + `));`
+	libRows, err := s.DB.Query(query, f.args...)
+	if err != nil {
+		return result, nil
+	}
+	defer libRows.Close()
+	for libRows.Next() {
+		var lib types.LibraryWeb
+		if err = libRows.Scan(&lib.ID, &lib.Email, &lib.Name, &lib.Address, &lib.ContactNumber, &lib.Latitude, &lib.Longitude); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		result.Libraries = append(result.Libraries, lib)
+	}
+	return result, nil
+}
+
+func (s *PostgresStorage) queryFacets(query string, withID bool, args ...any) ([]types.FacetCount, error) {
+	facets := []types.FacetCount{}
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var facet types.FacetCount
+		if withID {
+			err = rows.Scan(&facet.ID, &facet.Value, &facet.Count)
+		} else {
+			err = rows.Scan(&facet.Value, &facet.Count)
+		}
+		if err != nil {
+			return nil, err
+		}
+		facets = append(facets, facet)
+	}
+	return facets, nil
+}
+
+// suggest offers titles and authors that closely resemble a possibly misspelled input
+func (s *PostgresStorage) suggest(text string) ([]string, error) {
+	suggestions := []string{}
+	query := `select value from (
+		select name as value from book union select author from book
+	) as candidates
+	where lower(value) <> $1 and ($1 % lower(value) or $1 <% lower(value))
+	order by greatest(similarity($1, lower(value)), word_similarity($1, lower(value))) desc limit 5`
+	rows, err := s.DB.Query(query, text)
+	if err != nil {
+		return suggestions, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			return suggestions, err
+		}
+		suggestions = append(suggestions, value)
+	}
+	return suggestions, nil
+}
+
+func (s *PostgresStorage) Autocomplete(prefix string, limit int) (*[]types.Suggestion, error) {
+	suggestions := []types.Suggestion{}
+	prefix = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(strings.TrimSpace(prefix)))
+	if prefix == "" {
+		return &suggestions, nil
+	}
+	query := `select value, kind from (
+		select name as value, 'title' as kind, coalesce(cnt, 0) as cnt from book
+		left join (select count(library_id) as cnt, book_id from book_lib group by book_id) as popularity on book_id = id
+		where lower(name) like $1 || '%'
+		union all
+		select author, 'author', sum(coalesce(cnt, 0)) from book
+		left join (select count(library_id) as cnt, book_id from book_lib group by book_id) as popularity on book_id = id
+		where lower(author) like $1 || '%' group by author
+	) as candidates order by cnt desc, value limit $2`
+	rows, err := s.DB.Query(query, prefix, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var suggestion types.Suggestion
+		if err = rows.Scan(&suggestion.Value, &suggestion.Kind); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+	return &suggestions, nil
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildTSQuery(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", ""},
+		{"   ", ""},
+		{"War and Peace", "war & and & peace"},
+		{`"war and peace"`, "(war <-> and <-> peace)"},
+		{`tolstoy "war and peace" 1869`, "tolstoy & (war <-> and <-> peace) & 1869"},
+		{`"war and`, "(war <-> and)"},
+		{`"" " "`, ""},
+		{"dune*", "dune:*"},
+		{"***", ""},
+		{"a & b | !c", "a & b & c"},
+		{"(x <-> y)", "x & y"},
+		{"foo:* bar:A", "foo:* & bar & a"},
+		{"sci-fi", "sci & fi"},
+		{"don't", "don & t"},
+		{"'; drop table book; --", "drop & table & book"},
+		{`"Война и мир"`, "(война <-> и <-> мир)"},
+		{"Толст* ЁЖИК", "толст:* & ёжик"},
+		{"Café", "café"},
+	}
+	for _, tt := range tests {
+		if got := buildTSQuery(tt.input); got != tt.want {
+			t.Errorf("buildTSQuery(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"", nil},
+		{"*", nil},
+		{"!&|:", nil},
+		{"Hello, World!", []string{"hello", "world"}},
+		{"re-read*", []string{"re", "read:*"}},
+		{"*prefix", []string{"prefix"}},
+		{"Йога", []string{"йога"}},
+		{"\u0438\u0306\u043e\u0433\u0430", []string{"\u0438\u0306\u043e\u0433\u0430"}},
+		{"Пушкин,Лермонтов", []string{"пушкин", "лермонтов"}},
+		{"2001: a space odyssey", []string{"2001", "a", "space", "odyssey"}},
+	}
+	for _, tt := range tests {
+		got := splitWords(tt.input)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("splitWords(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
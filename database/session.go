@@ -0,0 +1,64 @@
+package database
+
+import (
+	"Libraria/types"
+	"time"
+)
+
+func (s *PostgresStorage) CreateSession(session *types.Session) error {
+	query := `insert into sessions (id, kind, subject_id, refresh_hash, created_at, expires_at) values ($1, $2, $3, $4, $5, $6)`
+	_, err := s.DB.Exec(query, session.ID, session.Kind, session.SubjectID, session.RefreshHash, session.CreatedAt, session.ExpiresAt)
+	return err
+}
+
+// GetSessionByRefreshHash also matches the previous refresh token so that its reuse can be detected
+func (s *PostgresStorage) GetSessionByRefreshHash(hash string) (*types.Session, error) {
+	query := `select id, kind, subject_id, refresh_hash, previous_hash, created_at, expires_at, rotated_at, revoked_at
+	from sessions where refresh_hash = $1 or previous_hash = $1 limit 1`
+	var session types.Session
+	err := s.DB.QueryRow(query, hash).Scan(session.Pointers())
+	return &session, err
+}
+
+func (s *PostgresStorage) GetSession(id string) (*types.Session, error) {
+	query := `select id, kind, subject_id, refresh_hash, previous_hash, created_at, expires_at, rotated_at, revoked_at
+	from sessions where id = $1`
+	var session types.Session
+	err := s.DB.QueryRow(query, id).Scan(session.Pointers())
+	return &session, err
+}
+
+func (s *PostgresStorage) RotateSession(id, hash string, expiresAt time.Time) error {
+	query := `update sessions set previous_hash = refresh_hash, refresh_hash = $2, expires_at = $3, rotated_at = $4
+	where id = $1 and revoked_at is null`
+	_, err := s.DB.Exec(query, id, hash, expiresAt, time.Now().UTC())
+	return err
+}
+
+func (s *PostgresStorage) RevokeSession(id string) error {
+	query := `update sessions set revoked_at = $2 where id = $1 and revoked_at is null`
+	_, err := s.DB.Exec(query, id, time.Now().UTC())
+	return err
+}
+
+func (s *PostgresStorage) RevokeSessions(kind string, subjectID uint) error {
+	query := `update sessions set revoked_at = $3 where kind = $1 and subject_id = $2 and revoked_at is null`
+	_, err := s.DB.Exec(query, kind, subjectID, time.Now().UTC())
+	return err
+}
+
+// RevokeOtherSessions keeps the session the request came from and ends the rest
+func (s *PostgresStorage) RevokeOtherSessions(kind string, subjectID uint, keepID string) error {
+	query := `update sessions set revoked_at = $4 where kind = $1 and subject_id = $2 and id <> $3 and revoked_at is null`
+	_, err := s.DB.Exec(query, kind, subjectID, keepID, time.Now().UTC())
+	return err
+}
+
+func (s *PostgresStorage) IsSessionActive(id string) bool {
+	var count int
+	query := `select count(*) from sessions where id = $1 and revoked_at is null and expires_at > $2`
+	if err := s.DB.QueryRow(query, id, time.Now().UTC()).Scan(&count); err != nil {
+		return false
+	}
+	return count > 0
+}
@@ -0,0 +1,190 @@
+package database
+
+import (
+	"Libraria/types"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// testStorage builds the tables in a schema of their own on the server named by LIBRARIA_TEST_DB,
+// a key=value connection string, and drops it afterwards. Without one the storage tests are skipped
+func testStorage(t *testing.T) *PostgresStorage {
+	t.Helper()
+	dsn := os.Getenv("LIBRARIA_TEST_DB")
+	if dsn == "" {
+		t.Skip("LIBRARIA_TEST_DB is not set")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("libraria_test_%d", time.Now().UnixNano())
+	if _, err = admin.Exec(`create schema ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		admin.Exec(`drop schema ` + schema + ` cascade`)
+		admin.Close()
+	})
+
+	db, err := sql.Open("postgres", dsn+" search_path="+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s := &PostgresStorage{DB: db}
+	if err = s.CreateTables(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// fixture inserts a row and returns its id
+func fixture(t *testing.T, s *PostgresStorage, query string, args ...any) uint {
+	t.Helper()
+	var id uint
+	if err := s.DB.QueryRow(query, args...).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func shelfAmount(t *testing.T, s *PostgresStorage, bookID, libraryID uint) int {
+	t.Helper()
+	var amount int
+	query := `select amount from book_lib where book_id = $1 and library_id = $2`
+	if err := s.DB.QueryRow(query, bookID, libraryID).Scan(&amount); err != nil {
+		t.Fatal(err)
+	}
+	return amount
+}
+
+func TestAvailabilityFollowsCopies(t *testing.T) {
+	s := testStorage(t)
+	bookID := fixture(t, s, `insert into book (name, author, year, genre) values ('Dune', 'Herbert', 1965, 'sf') returning id`)
+	libraryID := fixture(t, s, `insert into library (name, email) values ('Central', 'central@example.com') returning id`)
+	userID := fixture(t, s, `insert into account (firstname, lastname, email) values ('Ada', 'Reader', 'ada@example.com') returning id`)
+	check := func(step string, want int) {
+		t.Helper()
+		if got := shelfAmount(t, s, bookID, libraryID); got != want {
+			t.Errorf("%s: %d copies on the shelf, want %d", step, got, want)
+		}
+	}
+
+	// a title without copies keeps the count entered by hand
+	if err := s.AddLibraryBook(&types.LibraryBook{BookID: bookID, LibraryID: libraryID, Amount: 3}); err != nil {
+		t.Fatal(err)
+	}
+	check("count entered by hand", 3)
+
+	items := []*types.Item{
+		{BookID: bookID, LibraryID: libraryID, Barcode: "A1", Status: types.ItemAvailable, AddedAt: time.Now()},
+		{BookID: bookID, LibraryID: libraryID, Barcode: "A2", Status: types.ItemRepair, AddedAt: time.Now()},
+		{BookID: bookID, LibraryID: libraryID, Barcode: "A3", Status: types.ItemAvailable, AddedAt: time.Now()},
+	}
+	for _, item := range items {
+		if err := s.CreateItem(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("copies registered", 2)
+
+	if err := s.AddLibraryBook(&types.LibraryBook{BookID: bookID, LibraryID: libraryID, Amount: 1}); !errors.Is(err, errTracksCopies) {
+		t.Errorf("adding by count: got %v, want it refused", err)
+	}
+	if err := s.UpdateLibraryBook(&types.LibraryBook{BookID: bookID, LibraryID: libraryID, Amount: 10}); !errors.Is(err, errTracksCopies) {
+		t.Errorf("setting the count: got %v, want it refused", err)
+	}
+	check("count refused", 2)
+
+	loan := &types.Loan{BookID: bookID, LibraryID: libraryID, UserID: userID, IssuedAt: time.Now(), DueAt: time.Now().Add(time.Hour)}
+	if err := s.CheckoutBook(loan); err == nil {
+		t.Error("lending without a barcode was accepted for a title with copies")
+	}
+	loan.ItemID = items[0].ID
+	if err := s.CheckoutBook(loan); err != nil {
+		t.Fatal(err)
+	}
+	check("copy lent", 1)
+
+	items[2].Status = types.ItemRepair
+	if err := s.UpdateItem(items[2]); err != nil {
+		t.Fatal(err)
+	}
+	check("copy sent to repair", 0)
+
+	items[1].Status = types.ItemAvailable
+	if err := s.UpdateItem(items[1]); err != nil {
+		t.Fatal(err)
+	}
+	check("copy back from repair", 1)
+
+	if _, err := s.ReturnBook(int(loan.ID), int(libraryID)); err != nil {
+		t.Fatal(err)
+	}
+	check("copy returned", 2)
+}
+
+func TestPlaceHoldOnceUnderRace(t *testing.T) {
+	s := testStorage(t)
+	bookID := fixture(t, s, `insert into book (name, author, year, genre) values ('Dune', 'Herbert', 1965, 'sf') returning id`)
+	libraryID := fixture(t, s, `insert into library (name, email) values ('Central', 'central@example.com') returning id`)
+	userID := fixture(t, s, `insert into account (firstname, lastname, email) values ('Ada', 'Reader', 'ada@example.com') returning id`)
+	if err := s.AddLibraryBook(&types.LibraryBook{BookID: bookID, LibraryID: libraryID, Amount: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	const requests = 8
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			errs <- s.PlaceHold(&types.Hold{BookID: bookID, LibraryID: libraryID, UserID: userID, CreatedAt: time.Now()})
+		}()
+	}
+	placed := 0
+	for i := 0; i < requests; i++ {
+		err := <-errs
+		switch {
+		case err == nil:
+			placed++
+		case !errors.Is(err, ErrHoldExists):
+			t.Errorf("got %v, want ErrHoldExists", err)
+		}
+	}
+	var active int
+	query := `select count(*) from holds where user_id = $1 and status in ('waiting', 'ready')`
+	if err := s.DB.QueryRow(query, userID).Scan(&active); err != nil {
+		t.Fatal(err)
+	}
+	if placed != 1 || active != 1 {
+		t.Errorf("%d holds placed and %d active, want one of each", placed, active)
+	}
+}
+
+func TestTakeRateTokensAllOrNothing(t *testing.T) {
+	s := testStorage(t)
+	ip := types.RateLimit{Burst: 3, Every: time.Hour}
+	email := types.RateLimit{Burst: 1, Every: time.Hour}
+	both := map[string]types.RateLimit{"login:ip:1.1.1.1": ip, "login:email:a@example.com": email}
+
+	for i, want := range []bool{true, false, false} {
+		wait, err := s.TakeRateTokens(both)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (wait == 0) != want {
+			t.Errorf("request %d let through %v, want %v", i+1, wait == 0, want)
+		}
+	}
+	var tokens float64
+	if err := s.DB.QueryRow(`select tokens from rate_limits where key = 'login:ip:1.1.1.1'`).Scan(&tokens); err != nil {
+		t.Fatal(err)
+	}
+	if tokens < 1.9 || tokens > 2.1 {
+		t.Errorf("IP bucket holds %.2f tokens, want 2 after one accepted request", tokens)
+	}
+}
@@ -1,8 +1,10 @@
 package database
 
 import (
+	"Libraria/types"
+	"context"
+	"errors"
 	"fmt"
-	"time"
 )
 
 func (s *PostgresStorage) CreateTables() error {
@@ -17,6 +19,12 @@ func (s *PostgresStorage) CreateTables() error {
 		return err
 	}
 
+	query = `ALTER TABLE account ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'patron';`
+	_, err = s.DB.Exec(query)
+	if err != nil {
+		return err
+	}
+
 	query = `create table if not exists library(
     id SERIAL PRIMARY KEY,
     name varchar(200),
@@ -45,6 +53,36 @@ func (s *PostgresStorage) CreateTables() error {
 		return err
 	}
 
+	query = `ALTER TABLE book ADD COLUMN IF NOT EXISTS language VARCHAR(50) NOT NULL DEFAULT ''`
+	_, err = s.DB.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	query = `CREATE EXTENSION IF NOT EXISTS pg_trgm`
+	_, err = s.DB.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	query = `CREATE INDEX IF NOT EXISTS book_name_trgm_idx ON book USING GIN (lower(name) gin_trgm_ops)`
+	_, err = s.DB.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	query = `CREATE INDEX IF NOT EXISTS book_author_trgm_idx ON book USING GIN (lower(author) gin_trgm_ops)`
+	_, err = s.DB.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	query = `CREATE INDEX IF NOT EXISTS book_search_idx ON book USING GIN (` + bookDocument + `)`
+	_, err = s.DB.Exec(query)
+	if err != nil {
+		return err
+	}
+
 	query = `create table if not exists password_reset(
     id SERIAL PRIMARY KEY,
     email varchar(255),
@@ -93,137 +131,378 @@ func (s *PostgresStorage) CreateTables() error {
 		return err
 	}
 
-	query = `CREATE TABLE IF NOT EXISTS last_books(
-    user_id SERIAL NOT NULL,
-    book_id SERIAL NOT NULL,
-    time TIMESTAMP NOT NULL
+	query = `ALTER TABLE book_lib ADD COLUMN IF NOT EXISTS amount INT NOT NULL DEFAULT 1;`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	if err = s.uniqueBookLib(); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS loans(
+    id SERIAL PRIMARY KEY,
+    book_id INT NOT NULL,
+    library_id INT NOT NULL,
+    user_id INT NOT NULL,
+    issued_at TIMESTAMP NOT NULL,
+    due_at TIMESTAMP NOT NULL,
+    returned_at TIMESTAMP
 	)`
 	if _, err = s.DB.Exec(query); err != nil {
 		return err
 	}
 
-	return nil
-}
+	query = `CREATE TABLE IF NOT EXISTS items(
+    id SERIAL PRIMARY KEY,
+    book_id INT NOT NULL,
+    library_id INT NOT NULL,
+    barcode VARCHAR(50) NOT NULL UNIQUE,
+    condition VARCHAR(50) NOT NULL DEFAULT '',
+    shelf VARCHAR(50) NOT NULL DEFAULT '',
+    status VARCHAR(20) NOT NULL DEFAULT 'available',
+    added_at TIMESTAMP NOT NULL
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
 
-func (s *PostgresStorage) DropTable(name string) error {
-	query := "drop table %s"
-	_, err := s.DB.Exec(fmt.Sprintf(query, name))
-	return err
-}
+	query = `ALTER TABLE loans ADD COLUMN IF NOT EXISTS item_id INT NOT NULL DEFAULT 0;`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
 
-func (s *PostgresStorage) ClearRequests() {
-	fmt.Println("Clearing requests has been started")
-	for {
-		rows, err := s.DB.Query(`select id from user_requests where expires_at < NOW() at time zone 'UTC';`)
-		if err != nil {
-			fmt.Println("Error while clearing requests:", err)
-			continue
-		} else {
-			for rows.Next() {
-				var id int
-				err = rows.Scan(&id)
-				if err != nil {
-					fmt.Println("Error while iterating requests", err)
-					continue
-				}
-				_, err = s.DB.Exec(`delete from user_requests where id = $1`, id)
-				if err != nil {
-					fmt.Println("Error while deleting requests", err)
-					continue
-				}
-				fmt.Println("Request with id ", id, " was deleted")
-			}
-			rows.Close()
-		}
+	query = `CREATE TABLE IF NOT EXISTS library_hours(
+    library_id INT NOT NULL,
+    weekday INT NOT NULL,
+    opens VARCHAR(5) NOT NULL,
+    closes VARCHAR(5) NOT NULL,
+    PRIMARY KEY (library_id, weekday)
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
 
-		rows, err = s.DB.Query(`select id from lib_requests where expires_at < NOW() at time zone 'UTC';`)
-		if err != nil {
-			fmt.Println("Error while clearing requests:", err)
-			continue
-		} else {
-			for rows.Next() {
-				var id int
-				err = rows.Scan(&id)
-				if err != nil {
-					fmt.Println("Error while iterating requests", err)
-					continue
-				}
-				_, err = s.DB.Exec(`delete from lib_requests where id = $1`, id)
-				if err != nil {
-					fmt.Println("Error while deleting requests", err)
-					continue
-				}
-				fmt.Println("Request with id ", id, " was deleted")
-			}
-			rows.Close()
-		}
+	query = `CREATE TABLE IF NOT EXISTS library_exceptions(
+    library_id INT NOT NULL,
+    date DATE NOT NULL,
+    closed BOOLEAN NOT NULL DEFAULT TRUE,
+    opens VARCHAR(5) NOT NULL DEFAULT '',
+    closes VARCHAR(5) NOT NULL DEFAULT '',
+    note VARCHAR(100) NOT NULL DEFAULT '',
+    PRIMARY KEY (library_id, date)
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
 
-		rows, err = s.DB.Query(`select id from password_reset where expires_at < NOW() at time zone 'UTC';`)
-		if err != nil {
-			fmt.Println("Error while clearing requests:", err)
-			continue
-		} else {
-			for rows.Next() {
-				var id int
-				err = rows.Scan(&id)
-				if err != nil {
-					fmt.Println("Error while iterating requests", err)
-					continue
-				}
-				_, err = s.DB.Exec(`delete from password_reset where id = $1`, id)
-				if err != nil {
-					fmt.Println("Error while deleting requests", err)
-					continue
-				}
-				fmt.Println("Request with id ", id, " was deleted")
-			}
-			rows.Close()
-		}
+	query = `CREATE TABLE IF NOT EXISTS holds(
+    id SERIAL PRIMARY KEY,
+    book_id INT NOT NULL,
+    library_id INT NOT NULL,
+    user_id INT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'waiting',
+    created_at TIMESTAMP NOT NULL,
+    ready_at TIMESTAMP,
+    expires_at TIMESTAMP
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
 
-		rows, err = s.DB.Query(`select user_id, book_id from
-		(SELECT user_id, book_id, time, row_number() over(PARTITION BY user_id ORDER BY time desc) AS row_num
-		FROM last_books) as subquery
-		where row_num > 5;`)
-		if err != nil {
-			continue
-		} else {
-			for rows.Next() {
-				var user_id, book_id int
-				err = rows.Scan(&user_id, &book_id)
-				if err != nil {
-					continue
-				}
-				_, err = s.DB.Exec(`delete from last_books where user_id = $1 and book_id = $2`, user_id, book_id)
-				if err != nil {
-					continue
-				}
-			}
-			rows.Close()
-		}
+	if err = s.uniqueActiveHolds(); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS sessions(
+    id VARCHAR(64) PRIMARY KEY,
+    kind VARCHAR(20) NOT NULL,
+    subject_id INT NOT NULL,
+    refresh_hash VARCHAR(64) NOT NULL,
+    previous_hash VARCHAR(64) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    rotated_at TIMESTAMP,
+    revoked_at TIMESTAMP
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS rate_limits(
+    key VARCHAR(320) PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS login_failures(
+    email VARCHAR(320) PRIMARY KEY,
+    failures INT NOT NULL,
+    first_failed_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS two_factor(
+    kind VARCHAR(20) NOT NULL,
+    subject_id INT NOT NULL,
+    secret VARCHAR(64) NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT false,
+    last_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (kind, subject_id)
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS recovery_codes(
+    kind VARCHAR(20) NOT NULL,
+    subject_id INT NOT NULL,
+    code_hash VARCHAR(64) NOT NULL
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS login_challenges(
+    id VARCHAR(64) PRIMARY KEY,
+    kind VARCHAR(20) NOT NULL,
+    subject_id INT NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS api_keys(
+    id SERIAL PRIMARY KEY,
+    library_id INT NOT NULL,
+    name VARCHAR(50) NOT NULL,
+    prefix VARCHAR(20) NOT NULL,
+    key_hash VARCHAR(64) UNIQUE NOT NULL,
+    scope VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
 
-		time.Sleep(1 * time.Minute)
+	query = `CREATE TABLE IF NOT EXISTS oidc_logins(
+    state VARCHAR(64) PRIMARY KEY,
+    verifier VARCHAR(128) NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
 	}
+
+	query = `CREATE TABLE IF NOT EXISTS account_identities(
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    account_id INT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (issuer, subject)
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS email_changes(
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(20) NOT NULL,
+    subject_id INT NOT NULL,
+    old_email VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    tag VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS account_deletions(
+    id SERIAL PRIMARY KEY,
+    account_id INT NOT NULL,
+    tag VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS user_locales(
+    kind VARCHAR(20) NOT NULL,
+    subject_id INT NOT NULL,
+    locale VARCHAR(20) NOT NULL,
+    PRIMARY KEY (kind, subject_id)
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS email_outbox(
+    id SERIAL PRIMARY KEY,
+    recipient VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `ALTER TABLE email_outbox ADD COLUMN IF NOT EXISTS html TEXT NOT NULL DEFAULT ''`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `ALTER TABLE email_outbox ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `ALTER TABLE email_outbox ADD COLUMN IF NOT EXISTS locale VARCHAR(10) NOT NULL DEFAULT ''`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE INDEX IF NOT EXISTS email_outbox_due_idx ON email_outbox (next_attempt_at) WHERE status = 'pending'`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS notifications(
+    event VARCHAR(50) NOT NULL,
+    ref_id INT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (event, ref_id)
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS job_runs(
+    name VARCHAR(50) PRIMARY KEY,
+    instance VARCHAR(255) NOT NULL,
+    started_at TIMESTAMP NOT NULL,
+    finished_at TIMESTAMP NOT NULL,
+    duration_ms BIGINT NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    runs INT NOT NULL DEFAULT 0,
+    failures INT NOT NULL DEFAULT 0,
+    last_success_at TIMESTAMP
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS last_books(
+    user_id SERIAL NOT NULL,
+    book_id SERIAL NOT NULL,
+    time TIMESTAMP NOT NULL
+	)`
+	if _, err = s.DB.Exec(query); err != nil {
+		return err
+	}
+
+	return nil
 }
 
-func (s *PostgresStorage) OneTimeClear() {
-	fmt.Println("One time started")
-	start := time.Now()
-	_, err := s.DB.Exec(`delete from user_requests where expires_at < NOW() at time zone 'UTC'`)
+// uniqueBookLib gives book_lib one row per book and library. Older trees could insert the same pair twice,
+// such rows are merged into one holding their summed amount before the unique index is built
+func (s *PostgresStorage) uniqueBookLib() error {
+	tx, err := s.DB.Begin()
 	if err != nil {
-		fmt.Println("Error while clearing user requests:", err)
+		return err
 	}
+	defer tx.Rollback()
 
-	_, err = s.DB.Exec(`delete from lib_requests where expires_at < NOW() at time zone 'UTC';`)
-	if err != nil {
-		fmt.Println("Error while clearing library requests:", err)
+	query := `update book_lib set amount = dup.amount
+	from (select book_id, library_id, sum(amount) as amount from book_lib group by book_id, library_id having count(*) > 1) as dup
+	where book_lib.book_id = dup.book_id and book_lib.library_id = dup.library_id`
+	if _, err = tx.Exec(query); err != nil {
+		return err
+	}
+	query = `delete from book_lib a using book_lib b
+	where a.book_id = b.book_id and a.library_id = b.library_id and a.ctid > b.ctid`
+	if _, err = tx.Exec(query); err != nil {
+		return err
+	}
+	query = `CREATE UNIQUE INDEX IF NOT EXISTS book_lib_book_library_idx ON book_lib (book_id, library_id)`
+	if _, err = tx.Exec(query); err != nil {
+		return err
 	}
+	return tx.Commit()
+}
 
-	_, err = s.DB.Exec(`delete from password_reset where expires_at < NOW() at time zone 'UTC';`)
+// uniqueActiveHolds allows one waiting or ready hold per patron, book and library. Holds placed twice by
+// racing requests are cancelled before the index is built, keeping a ready one over a waiting one and
+// putting the copies set aside for the cancelled ones back on the shelf
+func (s *PostgresStorage) uniqueActiveHolds() error {
+	tx, err := s.DB.Begin()
 	if err != nil {
-		fmt.Println("Error while clearing password requests:", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `with ranked as (
+		select id, book_id, library_id, status, row_number() over (
+			partition by user_id, book_id, library_id order by status = 'ready' desc, created_at, id
+		) as rank from holds where status in ('waiting', 'ready')
+	), cancelled as (
+		update holds set status = $1 from ranked where holds.id = ranked.id and ranked.rank > 1
+		returning holds.book_id, holds.library_id, ranked.status
+	)
+	update book_lib set amount = amount + released.count
+	from (select book_id, library_id, count(*) as count from cancelled where status = 'ready' group by book_id, library_id) as released
+	where book_lib.book_id = released.book_id and book_lib.library_id = released.library_id`
+	if _, err = tx.Exec(query, types.HoldCancelled); err != nil {
+		return err
 	}
+	query = `CREATE UNIQUE INDEX IF NOT EXISTS holds_active_idx ON holds (user_id, book_id, library_id)
+	WHERE status in ('waiting', 'ready')`
+	if _, err = tx.Exec(query); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	query := `WITH deletion_candidates AS (
+func (s *PostgresStorage) DropTable(name string) error {
+	query := "drop table %s"
+	_, err := s.DB.Exec(fmt.Sprintf(query, name))
+	return err
+}
+
+// ClearExpired deletes rows nobody can use anymore, it runs as the cleanup job
+func (s *PostgresStorage) ClearExpired(ctx context.Context) error {
+	queries := []struct {
+		what  string
+		query string
+	}{
+		{"user requests", `delete from user_requests where expires_at < NOW() at time zone 'UTC'`},
+		{"library requests", `delete from lib_requests where expires_at < NOW() at time zone 'UTC'`},
+		{"password requests", `delete from password_reset where expires_at < NOW() at time zone 'UTC'`},
+		{"email changes", `delete from email_changes where expires_at < NOW() at time zone 'UTC'`},
+		{"account deletions", `delete from account_deletions where expires_at < NOW() at time zone 'UTC'`},
+		{"login challenges", `delete from login_challenges where expires_at < NOW() at time zone 'UTC'`},
+		{"sign-on attempts", `delete from oidc_logins where expires_at < NOW() at time zone 'UTC'`},
+		{"sent emails", `delete from email_outbox where status = 'sent' and sent_at < NOW() at time zone 'UTC' - interval '7 days'`},
+		{"rate limits", `delete from rate_limits where updated_at < NOW() at time zone 'UTC' - interval '1 day'`},
+		{"last_books", `WITH deletion_candidates AS (
 		SELECT user_id, book_id
 		FROM (
 			SELECT user_id, book_id, time,
@@ -235,11 +514,13 @@ func (s *PostgresStorage) OneTimeClear() {
 	DELETE FROM last_books
 	USING deletion_candidates
 	WHERE last_books.user_id = deletion_candidates.user_id
-	  AND last_books.book_id = deletion_candidates.book_id;`
-	_, err = s.DB.Exec(query)
-	if err != nil {
-		fmt.Println("Error while clearing last_books: ", err)
+	  AND last_books.book_id = deletion_candidates.book_id;`},
+	}
+	var errs []error
+	for _, q := range queries {
+		if _, err := s.DB.ExecContext(ctx, q.query); err != nil {
+			errs = append(errs, fmt.Errorf("clearing %s: %w", q.what, err))
+		}
 	}
-	end := time.Now()
-	fmt.Println("One time ended. Time consumed: ", end.Sub(start))
+	return errors.Join(errs...)
 }
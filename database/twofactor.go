@@ -0,0 +1,100 @@
+package database
+
+import (
+	"Libraria/types"
+	"time"
+)
+
+func (s *PostgresStorage) GetTwoFactor(kind string, subjectID uint) (*types.TwoFactor, error) {
+	var tf types.TwoFactor
+	query := `select kind, subject_id, secret, enabled, last_step from two_factor where kind = $1 and subject_id = $2`
+	err := s.DB.QueryRow(query, kind, subjectID).Scan(&tf.Kind, &tf.SubjectID, &tf.Secret, &tf.Enabled, &tf.LastStep)
+	return &tf, err
+}
+
+// SaveTwoFactor starts an enrollment over with a fresh secret, it stays disabled until a code is verified
+func (s *PostgresStorage) SaveTwoFactor(tf *types.TwoFactor) error {
+	query := `insert into two_factor (kind, subject_id, secret, enabled, last_step, created_at) values ($1, $2, $3, false, 0, $4)
+	on conflict (kind, subject_id) do update set secret = excluded.secret, enabled = false, last_step = 0, created_at = excluded.created_at`
+	_, err := s.DB.Exec(query, tf.Kind, tf.SubjectID, tf.Secret, time.Now().UTC())
+	return err
+}
+
+// EnableTwoFactor switches the enrollment on and replaces the recovery codes
+func (s *PostgresStorage) EnableTwoFactor(kind string, subjectID uint, codeHashes []string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`update two_factor set enabled = true where kind = $1 and subject_id = $2`, kind, subjectID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`delete from recovery_codes where kind = $1 and subject_id = $2`, kind, subjectID); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		query := `insert into recovery_codes (kind, subject_id, code_hash) values ($1, $2, $3)`
+		if _, err = tx.Exec(query, kind, subjectID, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStorage) DisableTwoFactor(kind string, subjectID uint) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`delete from recovery_codes where kind = $1 and subject_id = $2`, kind, subjectID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`delete from two_factor where kind = $1 and subject_id = $2`, kind, subjectID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records the time step of an accepted code, a code can not be replayed within its window
+func (s *PostgresStorage) UseTOTPStep(kind string, subjectID uint, step int64) (bool, error) {
+	query := `update two_factor set last_step = $3 where kind = $1 and subject_id = $2 and last_step < $3`
+	res, err := s.DB.Exec(query, kind, subjectID, step)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+// UseRecoveryCode burns a recovery code, each one works once
+func (s *PostgresStorage) UseRecoveryCode(kind string, subjectID uint, codeHash string) (bool, error) {
+	query := `delete from recovery_codes where kind = $1 and subject_id = $2 and code_hash = $3`
+	res, err := s.DB.Exec(query, kind, subjectID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func (s *PostgresStorage) CreateLoginChallenge(challenge *types.LoginChallenge) error {
+	query := `insert into login_challenges (id, kind, subject_id, expires_at) values ($1, $2, $3, $4)`
+	_, err := s.DB.Exec(query, challenge.ID, challenge.Kind, challenge.SubjectID, challenge.ExpiresAt)
+	return err
+}
+
+func (s *PostgresStorage) GetLoginChallenge(id string) (*types.LoginChallenge, error) {
+	var challenge types.LoginChallenge
+	query := `select id, kind, subject_id, expires_at from login_challenges where id = $1 and expires_at > $2`
+	err := s.DB.QueryRow(query, id, time.Now().UTC()).Scan(&challenge.ID, &challenge.Kind, &challenge.SubjectID, &challenge.ExpiresAt)
+	return &challenge, err
+}
+
+func (s *PostgresStorage) DeleteLoginChallenge(id string) error {
+	_, err := s.DB.Exec(`delete from login_challenges where id = $1`, id)
+	return err
+}
@@ -2,38 +2,147 @@ package mail
 
 import (
 	"fmt"
-	"net/smtp"
 	"os"
+	"time"
 )
 
+// Mailer is what the server needs from the mail package, the builders render a message
+// in the recipient's locale and leave it to the caller whether to send it now or queue it
+type Mailer interface {
+	Send(msg *Message) error
+	SendMessage(from, subject, body string, to []string) error
+	MatchLocale(header string) string
+	Locales() []string
+	EmailConfirmation(to, locale, appeal, link string, expiresAt time.Time) (*Message, error)
+	PasswordReset(to, locale, appeal, link string) (*Message, error)
+	HoldReady(to, locale, appeal, book, library string, expiresAt time.Time) (*Message, error)
+	EmailChangeConfirm(to, locale, appeal, link string) (*Message, error)
+	EmailChangeNotice(to, locale, appeal, newEmail string) (*Message, error)
+	AccountDeletion(to, locale, appeal, link string) (*Message, error)
+	DueReminder(to, locale, appeal, book, library string, dueAt time.Time) (*Message, error)
+	Overdue(to, locale, appeal, book, library string, dueAt time.Time, days int, final bool) (*Message, error)
+}
+
 type Email struct {
-	auth smtp.Auth
+	transport Transport
+	templates *Templates
+	from      string
+}
+
+func NewEmail(transport Transport, templates *Templates, from string) *Email {
+	return &Email{
+		transport: transport,
+		templates: templates,
+		from:      from,
+	}
 }
 
-func NewEmailConnection() *Email {
+// NewEmailConnection picks the transport from MAIL_TRANSPORT: smtp (default), file or memory
+func NewEmailConnection() (*Email, error) {
 	email_username := os.Getenv("EMAIL")
 	email_password := os.Getenv("EMAILPASSWORD")
-	auth := smtp.PlainAuth("", email_username, email_password, "smtp.gmail.com")
-	return &Email{
-		auth: auth,
+	from := getenv("MAIL_FROM", email_username)
+	if from == "" {
+		from = "Libraria <no-reply@localhost>"
+	}
+	templates, err := LoadTemplates(getenv("MAIL_TEMPLATES", "templates/email"), getenv("MAIL_DEFAULT_LOCALE", "en"))
+	if err != nil {
+		return nil, err
+	}
+
+	switch transport := getenv("MAIL_TRANSPORT", "smtp"); transport {
+	case "smtp":
+		security := getenv("SMTP_SECURITY", SecurityStartTLS)
+		port := "587"
+		switch security {
+		case SecurityTLS:
+			port = "465"
+		case SecurityNone:
+			port = "25"
+		case SecurityStartTLS:
+		default:
+			return nil, fmt.Errorf("invalid SMTP_SECURITY: %s", security)
+		}
+		auth := getenv("SMTP_AUTH", AuthPlain)
+		switch auth {
+		case AuthPlain, AuthLogin, AuthCRAMMD5, AuthNone:
+		default:
+			return nil, fmt.Errorf("invalid SMTP_AUTH: %s", auth)
+		}
+		return NewEmail(&SMTPTransport{
+			Host:     getenv("SMTP_HOST", "smtp.gmail.com"),
+			Port:     getenv("SMTP_PORT", port),
+			Username: email_username,
+			Password: email_password,
+			Security: security,
+			Auth:     auth,
+			Timeout:  30 * time.Second,
+		}, templates, from), nil
+	case "file":
+		return NewEmail(&FileTransport{Dir: getenv("MAIL_DIR", "mail_outbox")}, templates, from), nil
+	case "memory":
+		return NewEmail(&MemoryTransport{}, templates, from), nil
+	default:
+		return nil, fmt.Errorf("invalid MAIL_TRANSPORT: %s", transport)
+	}
+}
+
+func getenv(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Send fills in the default sender and hands the message to the transport
+func (email *Email) Send(msg *Message) error {
+	if msg.From == "" {
+		msg.From = email.from
 	}
+	return email.transport.Send(msg)
 }
 
 func (email *Email) SendMessage(from, subject, body string, to []string) error {
-	msg := "Subject: " + subject + "\n" + body
-	return smtp.SendMail("smtp.gmail.com:587", email.auth, from, to, []byte(msg))
+	return email.Send(&Message{From: from, To: to, Subject: subject, Body: body})
+}
+
+func (email *Email) MatchLocale(header string) string {
+	return email.templates.Match(header)
+}
+
+func (email *Email) Locales() []string {
+	return email.templates.Locales()
+}
+
+func (email *Email) EmailConfirmation(to, locale, appeal, link string, expiresAt time.Time) (*Message, error) {
+	return email.templates.Render("confirmation", locale, to, map[string]any{"Appeal": appeal, "Link": link, "ExpiresAt": expiresAt})
+}
+
+func (email *Email) PasswordReset(to, locale, appeal, link string) (*Message, error) {
+	return email.templates.Render("password_reset", locale, to, map[string]any{"Appeal": appeal, "Link": link})
+}
+
+func (email *Email) HoldReady(to, locale, appeal, book, library string, expiresAt time.Time) (*Message, error) {
+	return email.templates.Render("hold_ready", locale, to, map[string]any{"Appeal": appeal, "Book": book, "Library": library, "ExpiresAt": expiresAt})
+}
+
+func (email *Email) EmailChangeConfirm(to, locale, appeal, link string) (*Message, error) {
+	return email.templates.Render("email_change_confirm", locale, to, map[string]any{"Appeal": appeal, "Link": link})
+}
+
+func (email *Email) EmailChangeNotice(to, locale, appeal, newEmail string) (*Message, error) {
+	return email.templates.Render("email_change_notice", locale, to, map[string]any{"Appeal": appeal, "NewEmail": newEmail})
+}
+
+func (email *Email) AccountDeletion(to, locale, appeal, link string) (*Message, error) {
+	return email.templates.Render("account_deletion", locale, to, map[string]any{"Appeal": appeal, "Link": link})
 }
 
-func (email *Email) EmailConfirmationMessage(to string, appeal, link string) error {
-	msg := "Subject: [Libraria] Confirm registration\n"
-	body := fmt.Sprintf("Dear %s!\n\nTo complete registration please follow the link:\n\n %s", appeal, link)
-	msg += body
-	return smtp.SendMail("smtp.gmail.com:587", email.auth, "Libraria", []string{to}, []byte(msg))
+func (email *Email) DueReminder(to, locale, appeal, book, library string, dueAt time.Time) (*Message, error) {
+	return email.templates.Render("due_reminder", locale, to, map[string]any{"Appeal": appeal, "Book": book, "Library": library, "DueAt": dueAt})
 }
 
-func (email *Email) PasswordResetMessage(to string, appeal, link string) error {
-	msg := "Subject: [Libraria] Password reset\n"
-	body := fmt.Sprintf("Dear %s!\n\nAs you have requested for reset password instructions, here they are, please follow the URL:\n\n%s", appeal, link)
-	msg += body
-	return smtp.SendMail("smtp.gmail.com:587", email.auth, "Libraria", []string{to}, []byte(msg))
+// Overdue is sent again at every escalation step, final marks the last one
+func (email *Email) Overdue(to, locale, appeal, book, library string, dueAt time.Time, days int, final bool) (*Message, error) {
+	return email.templates.Render("overdue", locale, to, map[string]any{"Appeal": appeal, "Book": book, "Library": library, "DueAt": dueAt, "Days": days, "Final": final})
 }
@@ -0,0 +1,110 @@
+package mail
+
+import (
+	"Libraria/types"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// OutboxStore is the part of the storage the outbox worker needs
+type OutboxStore interface {
+	ClaimOutbox(limit int, lease time.Duration) (*[]types.OutboxMessage, error)
+	UpdateOutboxMessage(message *types.OutboxMessage) error
+}
+
+// Outbox delivers stored messages in the background, retrying with exponential backoff
+// until MaxAttempts is reached, after which the message is marked dead and waits for an admin
+type Outbox struct {
+	store       OutboxStore
+	mailer      Mailer
+	Batch       int
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+func NewOutbox(store OutboxStore, mailer Mailer) *Outbox {
+	return &Outbox{
+		store:       store,
+		mailer:      mailer,
+		Batch:       20,
+		MaxAttempts: 8,
+		BaseDelay:   30 * time.Second,
+		MaxDelay:    6 * time.Hour,
+	}
+}
+
+// NewOutboxMessage turns a composed message into an outbox row, expiresAt is when the message stops
+// being worth sending, such as when its link runs out, nil when it never does
+func NewOutboxMessage(msg *Message, expiresAt *time.Time) *types.OutboxMessage {
+	return &types.OutboxMessage{
+		Recipient: strings.Join(msg.To, ", "),
+		Subject:   msg.Subject,
+		Body:      msg.Body,
+		HTML:      msg.HTML,
+		ExpiresAt: expiresAt,
+		Locale:    msg.Locale,
+	}
+}
+
+// Deliver sends one batch of due messages and reports how many went out, it runs as a scheduled job
+func (o *Outbox) Deliver() int {
+	// the lease has to outlast a slow SMTP conversation for the whole batch
+	messages, err := o.store.ClaimOutbox(o.Batch, 10*time.Minute)
+	if err != nil {
+		fmt.Println("Error while claiming outbox:", err)
+		return 0
+	}
+	sent := 0
+	for i := range *messages {
+		message := &(*messages)[i]
+		if message.ExpiresAt != nil && time.Now().UTC().After(*message.ExpiresAt) {
+			message.Status = types.OutboxDead
+			message.LastError = "expired before delivery"
+			if err = o.store.UpdateOutboxMessage(message); err != nil {
+				fmt.Println("Error while updating outbox:", err)
+			}
+			continue
+		}
+		err = o.mailer.Send(&Message{
+			To:      strings.Split(message.Recipient, ", "),
+			Subject: message.Subject,
+			Body:    message.Body,
+			HTML:    message.HTML,
+			Locale:  message.Locale,
+		})
+		message.Attempts++
+		if err == nil {
+			now := time.Now().UTC()
+			message.Status = types.OutboxSent
+			message.SentAt = &now
+			message.LastError = ""
+			sent++
+		} else {
+			message.LastError = err.Error()
+			if message.Attempts >= o.MaxAttempts {
+				message.Status = types.OutboxDead
+			}
+			message.NextAttemptAt = time.Now().UTC().Add(o.backoff(message.Attempts))
+			fmt.Println("Error while sending email", message.ID, "attempt", message.Attempts, ":", err)
+		}
+		if err = o.store.UpdateOutboxMessage(message); err != nil {
+			fmt.Println("Error while updating outbox:", err)
+		}
+	}
+	return sent
+}
+
+// backoff doubles the delay after every failure, jittered so retries of one outage do not arrive together
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.BaseDelay
+	for i := 1; i < attempts && delay < o.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > o.MaxDelay {
+		delay = o.MaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
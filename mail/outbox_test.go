@@ -0,0 +1,100 @@
+package mail
+
+import (
+	"Libraria/types"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	o := NewOutbox(nil, nil)
+	for attempts := 1; attempts <= 12; attempts++ {
+		ceiling := o.BaseDelay << (attempts - 1)
+		if ceiling > o.MaxDelay || ceiling <= 0 {
+			ceiling = o.MaxDelay
+		}
+		for i := 0; i < 50; i++ {
+			if delay := o.backoff(attempts); delay < ceiling/2 || delay > ceiling {
+				t.Fatalf("attempt %d waited %s, want between %s and %s", attempts, delay, ceiling/2, ceiling)
+			}
+		}
+	}
+}
+
+type outboxStore struct {
+	claimed []types.OutboxMessage
+	updated []types.OutboxMessage
+}
+
+func (s *outboxStore) ClaimOutbox(limit int, lease time.Duration) (*[]types.OutboxMessage, error) {
+	claimed := s.claimed
+	s.claimed = nil
+	return &claimed, nil
+}
+
+func (s *outboxStore) UpdateOutboxMessage(message *types.OutboxMessage) error {
+	s.updated = append(s.updated, *message)
+	return nil
+}
+
+type failingTransport struct{}
+
+func (failingTransport) Send(msg *Message) error {
+	return fmt.Errorf("relay unavailable")
+}
+
+func TestDeliver(t *testing.T) {
+	past, future := time.Now().UTC().Add(-time.Minute), time.Now().UTC().Add(time.Hour)
+	store := &outboxStore{claimed: []types.OutboxMessage{
+		{ID: 1, Recipient: "a@example.com", Subject: "fresh", Body: "b", Locale: "ru", ExpiresAt: &future},
+		{ID: 2, Recipient: "b@example.com", Subject: "stale", Body: "b", ExpiresAt: &past},
+		{ID: 3, Recipient: "c@example.com", Subject: "no expiry", Body: "b"},
+	}}
+	transport := &MemoryTransport{}
+	outbox := NewOutbox(store, NewEmail(transport, nil, "no-reply@libraria.test"))
+
+	if sent := outbox.Deliver(); sent != 2 {
+		t.Errorf("sent %d, want 2", sent)
+	}
+	messages := transport.Messages()
+	if len(messages) != 2 || messages[0].Subject != "fresh" || messages[0].Locale != "ru" || messages[1].Subject != "no expiry" {
+		t.Errorf("transport got %+v", messages)
+	}
+	want := map[uint]string{1: types.OutboxSent, 2: types.OutboxDead, 3: types.OutboxSent}
+	for _, message := range store.updated {
+		if message.Status != want[message.ID] {
+			t.Errorf("message %d ended %s, want %s", message.ID, message.Status, want[message.ID])
+		}
+	}
+	if stale := store.updated[1]; stale.Attempts != 0 || stale.LastError == "" {
+		t.Errorf("an expired message must be dead-lettered without an attempt, got %+v", stale)
+	}
+}
+
+func TestDeliverRetriesThenDeadLetters(t *testing.T) {
+	store := &outboxStore{}
+	outbox := NewOutbox(store, NewEmail(failingTransport{}, nil, "no-reply@libraria.test"))
+	message := types.OutboxMessage{ID: 1, Recipient: "a@example.com", Status: types.OutboxPending}
+	for attempt := 1; attempt <= outbox.MaxAttempts; attempt++ {
+		store.claimed = []types.OutboxMessage{message}
+		before := time.Now().UTC()
+		if sent := outbox.Deliver(); sent != 0 {
+			t.Fatalf("a failing relay reported %d sent", sent)
+		}
+		message = store.updated[len(store.updated)-1]
+		if message.Attempts != attempt || message.LastError != "relay unavailable" {
+			t.Fatalf("after attempt %d: %+v", attempt, message)
+		}
+		if !message.NextAttemptAt.After(before) {
+			t.Errorf("attempt %d was not pushed back", attempt)
+		}
+		wantStatus := types.OutboxPending
+		if attempt == outbox.MaxAttempts {
+			wantStatus = types.OutboxDead
+		}
+		if message.Status != wantStatus {
+			t.Errorf("after attempt %d status is %s, want %s", attempt, message.Status, wantStatus)
+		}
+	}
+}
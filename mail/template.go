@@ -0,0 +1,160 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Every message the server sends, each needs <name>.txt in the default locale and may have <name>.html
+var templateNames = []string{"confirmation", "password_reset", "hold_ready", "email_change_confirm", "email_change_notice", "account_deletion", "due_reminder", "overdue"}
+
+// Templates holds the email copy loaded from disk, one directory per locale:
+//
+//	templates/email/en/confirmation.txt   {{define "subject"}}...{{end}} followed by the plain text body
+//	templates/email/en/confirmation.html  optional HTML alternative defining "content"
+//	templates/email/layout.html           shared HTML frame, renders {{template "content" .}}
+//
+// A locale may leave out any file, the default locale is used for it then
+type Templates struct {
+	defaultLocale string
+	text          map[string]map[string]*texttemplate.Template
+	html          map[string]map[string]*htmltemplate.Template
+}
+
+func LoadTemplates(dir, defaultLocale string) (*Templates, error) {
+	t := &Templates{
+		defaultLocale: defaultLocale,
+		text:          map[string]map[string]*texttemplate.Template{},
+		html:          map[string]map[string]*htmltemplate.Template{},
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	layout := filepath.Join(dir, "layout.html")
+	if _, err = os.Stat(layout); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		locale := strings.ToLower(entry.Name())
+		t.text[locale] = map[string]*texttemplate.Template{}
+		t.html[locale] = map[string]*htmltemplate.Template{}
+		for _, name := range templateNames {
+			path := filepath.Join(dir, entry.Name(), name)
+			if _, err = os.Stat(path + ".txt"); err == nil {
+				tmpl, err := texttemplate.ParseFiles(path + ".txt")
+				if err != nil {
+					return nil, err
+				}
+				if tmpl.Lookup("subject") == nil {
+					return nil, fmt.Errorf("%s.txt does not define a subject", path)
+				}
+				t.text[locale][name] = tmpl
+			}
+			if _, err = os.Stat(path + ".html"); err == nil {
+				tmpl, err := htmltemplate.ParseFiles(layout, path+".html")
+				if err != nil {
+					return nil, err
+				}
+				t.html[locale][name] = tmpl
+			}
+		}
+	}
+	for _, name := range templateNames {
+		if t.text[defaultLocale][name] == nil {
+			return nil, fmt.Errorf("template %s is missing for the default locale %s", name, defaultLocale)
+		}
+	}
+	return t, nil
+}
+
+// Render builds the message in the recipient's locale
+func (t *Templates) Render(name, locale, to string, data any) (*Message, error) {
+	locale = t.Match(locale)
+	text := t.text[locale][name]
+	if text == nil {
+		text = t.text[t.defaultLocale][name]
+	}
+	if text == nil {
+		return nil, fmt.Errorf("unknown email template %s", name)
+	}
+	var subject, body bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := text.Execute(&body, data); err != nil {
+		return nil, err
+	}
+	msg := &Message{
+		To:      []string{to},
+		Subject: strings.TrimSpace(subject.String()),
+		Body:    strings.TrimSpace(body.String()),
+		Locale:  locale,
+	}
+
+	html := t.html[locale][name]
+	if html == nil && t.text[locale][name] == nil {
+		html = t.html[t.defaultLocale][name]
+	}
+	if html != nil {
+		var buf bytes.Buffer
+		if err := html.ExecuteTemplate(&buf, "layout", data); err != nil {
+			return nil, err
+		}
+		msg.HTML = buf.String()
+	}
+	return msg, nil
+}
+
+// Locales lists the loaded locales
+func (t *Templates) Locales() []string {
+	locales := make([]string, 0, len(t.text))
+	for locale := range t.text {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Match picks the best loaded locale for an Accept-Language header or a single tag such as "ru-KZ"
+func (t *Templates) Match(header string) string {
+	type choice struct {
+		tag string
+		q   float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		if tag = strings.ToLower(strings.ReplaceAll(tag, "_", "-")); tag != "" && q > 0 {
+			choices = append(choices, choice{tag, q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	for _, c := range choices {
+		if _, ok := t.text[c.tag]; ok {
+			return c.tag
+		}
+		if base, _, _ := strings.Cut(c.tag, "-"); base != c.tag {
+			if _, ok := t.text[base]; ok {
+				return base
+			}
+		}
+	}
+	return t.defaultLocale
+}
@@ -0,0 +1,58 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadTemplates(t *testing.T) *Templates {
+	t.Helper()
+	templates, err := LoadTemplates("../templates/email", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return templates
+}
+
+func TestMatch(t *testing.T) {
+	templates := loadTemplates(t)
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", "en"},
+		{"ru", "ru"},
+		{"ru-RU,ru;q=0.9,en;q=0.8", "ru"},
+		{"ru_KZ", "ru"},
+		{"RU-ru", "ru"},
+		{"de-DE, en;q=0.5", "en"},
+		{"fr", "en"},
+		{"en;q=0.3, ru;q=0.7", "ru"},
+		{"ru;q=0, en", "en"},
+		{"ru;q=bogus", "ru"},
+		{" , ;q=1", "en"},
+	}
+	for _, tt := range tests {
+		if got := templates.Match(tt.header); got != tt.want {
+			t.Errorf("Match(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestRenderLocale(t *testing.T) {
+	templates := loadTemplates(t)
+	expiresAt := time.Date(2026, 3, 14, 15, 9, 0, 0, time.UTC)
+	msg, err := templates.Render("confirmation", "ru-RU", "reader@example.com", map[string]any{"Appeal": "Ada", "Link": "https://libraria.test/c/1", "ExpiresAt": expiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Locale != "ru" || !strings.Contains(msg.Subject, "Подтверждение") {
+		t.Errorf("rendered %q in %q, want the Russian copy", msg.Subject, msg.Locale)
+	}
+	for _, part := range []string{msg.Body, msg.HTML} {
+		if !strings.Contains(part, "14.03.2026 15:09 UTC") || !strings.Contains(part, "https://libraria.test/c/1") {
+			t.Errorf("rendered part misses the link or its expiry:\n%s", part)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Transport delivers a rendered message, SMTP in production and a file or memory outbox in development
+type Transport interface {
+	Send(msg *Message) error
+}
+
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	Body    string
+	HTML    string
+	Locale  string
+}
+
+// Bytes renders the message as RFC 5322 text, multipart/alternative when there is an HTML part
+func (msg *Message) Bytes() []byte {
+	var buf bytes.Buffer
+	domain := "libraria"
+	if _, host, ok := strings.Cut(msg.From, "@"); ok {
+		domain = strings.TrimSuffix(host, ">")
+	}
+	fmt.Fprintf(&buf, "From: %s\r\n", msg.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(msg.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", randomHex(16), domain)
+	if msg.Locale != "" {
+		fmt.Fprintf(&buf, "Content-Language: %s\r\n", msg.Locale)
+	}
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	if msg.HTML == "" {
+		writePart(&buf, "text/plain", msg.Body)
+		return buf.Bytes()
+	}
+	boundary := "libraria-" + randomHex(12)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	writePart(&buf, "text/plain", msg.Body)
+	fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+	writePart(&buf, "text/html", msg.HTML)
+	fmt.Fprintf(&buf, "\r\n--%s--\r\n", boundary)
+	return buf.Bytes()
+}
+
+func writePart(buf *bytes.Buffer, contentType, content string) {
+	fmt.Fprintf(buf, "Content-Type: %s; charset=UTF-8\r\n", contentType)
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	body := quotedprintable.NewWriter(buf)
+	body.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(content, "\r\n", "\n"), "\n", "\r\n")))
+	body.Close()
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+const (
+	SecurityStartTLS = "starttls"
+	SecurityTLS      = "tls"
+	SecurityNone     = "none"
+
+	AuthPlain   = "plain"
+	AuthLogin   = "login"
+	AuthCRAMMD5 = "cram-md5"
+	AuthNone    = "none"
+)
+
+// SMTPTransport talks to any relay, with STARTTLS on the submission port or implicit TLS on 465
+type SMTPTransport struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	Security string
+	Auth     string
+	Timeout  time.Duration
+}
+
+func (t *SMTPTransport) Send(msg *Message) error {
+	addr := net.JoinHostPort(t.Host, t.Port)
+	dialer := &net.Dialer{Timeout: t.Timeout}
+	var conn net.Conn
+	var err error
+	if t.Security == SecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: t.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, t.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if t.Security == SecurityStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not support STARTTLS", t.Host)
+		}
+		if err = client.StartTLS(&tls.Config{ServerName: t.Host}); err != nil {
+			return err
+		}
+	}
+	if auth := t.auth(); auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return fmt.Errorf("%s does not support authentication", t.Host)
+		}
+		if err = client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(envelope(msg.From)); err != nil {
+		return err
+	}
+	for _, to := range msg.To {
+		if err = client.Rcpt(envelope(to)); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (t *SMTPTransport) auth() smtp.Auth {
+	if t.Username == "" {
+		return nil
+	}
+	switch t.Auth {
+	case AuthNone:
+		return nil
+	case AuthLogin:
+		return &loginAuth{username: t.Username, password: t.Password}
+	case AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(t.Username, t.Password)
+	}
+	return smtp.PlainAuth("", t.Username, t.Password, t.Host)
+}
+
+// envelope strips a display name, "Libraria <no-reply@x.org>" becomes "no-reply@x.org"
+func envelope(address string) string {
+	if start := strings.LastIndex(address, "<"); start >= 0 {
+		return strings.TrimSuffix(address[start+1:], ">")
+	}
+	return address
+}
+
+// loginAuth is the LOGIN mechanism some relays still require, net/smtp only ships PLAIN and CRAM-MD5
+type loginAuth struct {
+	username string
+	password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" {
+		return "", nil, fmt.Errorf("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+}
@@ -0,0 +1,270 @@
+package mail
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func parseMessage(t *testing.T, msg *Message) *mail.Message {
+	t.Helper()
+	parsed, err := mail.ReadMessage(strings.NewReader(string(msg.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func readPart(t *testing.T, header textproto.MIMEHeader, body io.Reader, wantType string) string {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != wantType || params["charset"] != "UTF-8" {
+		t.Errorf("part is %s charset %s, want %s in UTF-8", mediaType, params["charset"], wantType)
+	}
+	if header.Get("Content-Transfer-Encoding") != "quoted-printable" {
+		t.Errorf("part encoding is %q", header.Get("Content-Transfer-Encoding"))
+	}
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("encoded line is %d characters long", len(line))
+		}
+	}
+	decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(string(raw))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(decoded)
+}
+
+func TestMessageBytesPlain(t *testing.T) {
+	body := "Здравствуйте!\n\nПерейдите по ссылке: https://libraria.test/account/confirm/" + strings.Repeat("a", 80) + "\nСпасибо."
+	msg := &Message{
+		From:    "Libraria <no-reply@libraria.test>",
+		To:      []string{"reader@example.com", "second@example.com"},
+		Subject: "Подтверждение регистрации",
+		Body:    body,
+		Locale:  "ru",
+	}
+	parsed := parseMessage(t, msg)
+
+	if got := parsed.Header.Get("From"); got != msg.From {
+		t.Errorf("From is %q", got)
+	}
+	if got := parsed.Header.Get("To"); got != "reader@example.com, second@example.com" {
+		t.Errorf("To is %q", got)
+	}
+	raw := parsed.Header.Get("Subject")
+	if !strings.HasPrefix(raw, "=?utf-8?q?") {
+		t.Errorf("non-ASCII subject is not encoded: %q", raw)
+	}
+	if subject, err := new(mime.WordDecoder).DecodeHeader(raw); err != nil || subject != msg.Subject {
+		t.Errorf("subject decodes to %q, %v", subject, err)
+	}
+	if _, err := parsed.Header.Date(); err != nil {
+		t.Errorf("Date header: %v", err)
+	}
+	if id := parsed.Header.Get("Message-ID"); !strings.HasSuffix(id, "@libraria.test>") {
+		t.Errorf("Message-ID %q does not use the sender domain", id)
+	}
+	if got := parsed.Header.Get("Content-Language"); got != "ru" {
+		t.Errorf("Content-Language is %q", got)
+	}
+	if got := parsed.Header.Get("MIME-Version"); got != "1.0" {
+		t.Errorf("MIME-Version is %q", got)
+	}
+	got := readPart(t, textproto.MIMEHeader(parsed.Header), parsed.Body, "text/plain")
+	if want := strings.ReplaceAll(body, "\n", "\r\n"); got != want {
+		t.Errorf("body decodes to %q, want %q", got, want)
+	}
+}
+
+func TestMessageBytesAlternative(t *testing.T) {
+	msg := &Message{
+		From:    "no-reply@libraria.test",
+		To:      []string{"reader@example.com"},
+		Subject: "Confirm registration",
+		Body:    "Follow the link",
+		HTML:    `<p>Follow <a href="https://libraria.test/confirm?a=1&b=2">the link</a></p>`,
+	}
+	parsed := parseMessage(t, msg)
+	if got := parsed.Header.Get("Subject"); got != msg.Subject {
+		t.Errorf("ASCII subject changed to %q", got)
+	}
+	if got := parsed.Header.Get("Content-Language"); got != "" {
+		t.Errorf("Content-Language %q set without a locale", got)
+	}
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type is %q", parsed.Header.Get("Content-Type"))
+	}
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	var parts []string
+	for _, want := range []string{"text/plain", "text/html"} {
+		part, err := reader.NextRawPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, readPart(t, part.Header, part, want))
+	}
+	if _, err = reader.NextRawPart(); err != io.EOF {
+		t.Errorf("expected two parts, got %v", err)
+	}
+	if parts[0] != msg.Body || parts[1] != msg.HTML {
+		t.Errorf("parts decode to %q", parts)
+	}
+}
+
+// smtpSession is what the stub relay saw during one conversation
+type smtpSession struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// stubSMTP accepts one conversation on a local port, extensions are announced after EHLO
+func stubSMTP(t *testing.T, extensions ...string) (string, <-chan smtpSession) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	done := make(chan smtpSession, 1)
+	go func() {
+		var session smtpSession
+		defer func() { done <- session }()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		reply := func(format string, args ...any) { text.PrintfLine(format, args...) }
+		reply("220 stub ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO":
+				lines := append([]string{"stub"}, extensions...)
+				for i, ext := range lines {
+					if i < len(lines)-1 {
+						reply("250-%s", ext)
+					} else {
+						reply("250 %s", ext)
+					}
+				}
+			case "AUTH":
+				mechanism, initial, _ := strings.Cut(arg, " ")
+				if mechanism == "LOGIN" {
+					reply("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+					user, _ := text.ReadLine()
+					reply("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+					pass, _ := text.ReadLine()
+					u, _ := base64.StdEncoding.DecodeString(user)
+					p, _ := base64.StdEncoding.DecodeString(pass)
+					session.auth = "LOGIN " + string(u) + ":" + string(p)
+				} else {
+					decoded, _ := base64.StdEncoding.DecodeString(initial)
+					session.auth = mechanism + " " + strings.ReplaceAll(string(decoded), "\x00", ":")
+				}
+				reply("235 ok")
+			case "MAIL":
+				session.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+				reply("250 ok")
+			case "RCPT":
+				session.to = append(session.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+				reply("250 ok")
+			case "DATA":
+				reply("354 go ahead")
+				data, err := io.ReadAll(text.DotReader())
+				if err != nil {
+					return
+				}
+				session.data = string(data)
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 unknown command")
+			}
+		}
+	}()
+	return listener.Addr().String(), done
+}
+
+func TestSMTPTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		auth     string
+		wantAuth string
+	}{
+		{"plain", AuthPlain, "PLAIN :librarian:secret"},
+		{"login", AuthLogin, "LOGIN librarian:secret"},
+		{"none", AuthNone, ""},
+	}
+	for _, tt := range tests {
+		addr, done := stubSMTP(t, "AUTH PLAIN LOGIN")
+		host, port, _ := net.SplitHostPort(addr)
+		transport := &SMTPTransport{Host: host, Port: port, Username: "librarian", Password: "secret", Security: SecurityNone, Auth: tt.auth}
+		msg := &Message{
+			From:    "Libraria <no-reply@libraria.test>",
+			To:      []string{"Reader <reader@example.com>", "second@example.com"},
+			Subject: "Hello",
+			Body:    "Body text",
+		}
+		if err := transport.Send(msg); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		session := <-done
+		if session.auth != tt.wantAuth {
+			t.Errorf("%s: server saw auth %q, want %q", tt.name, session.auth, tt.wantAuth)
+		}
+		if session.from != "no-reply@libraria.test" {
+			t.Errorf("%s: envelope sender %q", tt.name, session.from)
+		}
+		if strings.Join(session.to, ",") != "reader@example.com,second@example.com" {
+			t.Errorf("%s: envelope recipients %v", tt.name, session.to)
+		}
+		parsed, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(session.data)))
+		if err != nil {
+			t.Fatalf("%s: relay received an unreadable message: %v", tt.name, err)
+		}
+		if parsed.Header.Get("Subject") != "Hello" {
+			t.Errorf("%s: relay received subject %q", tt.name, parsed.Header.Get("Subject"))
+		}
+	}
+}
+
+func TestSMTPTransportRequiresStartTLS(t *testing.T) {
+	addr, done := stubSMTP(t, "AUTH PLAIN")
+	host, port, _ := net.SplitHostPort(addr)
+	transport := &SMTPTransport{Host: host, Port: port, Username: "librarian", Password: "secret", Security: SecurityStartTLS, Auth: AuthPlain}
+	err := transport.Send(&Message{From: "no-reply@libraria.test", To: []string{"reader@example.com"}, Subject: "Hello", Body: "Body"})
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("got %v, want the missing STARTTLS refused", err)
+	}
+	if session := <-done; session.auth != "" || session.data != "" {
+		t.Error("credentials or mail went out over a plain connection")
+	}
+}
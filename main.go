@@ -4,6 +4,8 @@ import (
 	"Libraria/controllers"
 	"Libraria/database"
 	"Libraria/mail"
+	"Libraria/oidc"
+	"Libraria/types"
 	"fmt"
 	_ "github.com/lib/pq"
 	"log"
@@ -21,23 +23,26 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if err = types.LoadPasswordPolicy(); err != nil {
+		log.Fatal(err)
+	}
+
 	//fmt.Println(store.DropTable("book"))
 
 	fmt.Println("Initializing Mail connection")
-	email := mail.NewEmailConnection()
+	email, err := mail.NewEmailConnection()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	lib := controllers.NewLibServer(":8000", store, *email)
+	lib := controllers.NewLibServer(":8000", store, email, oidc.NewProvider())
 
-	//go store.ClearRequests()
 	//s, _ := bcrypt.GenerateFromPassword([]byte("Password"), bcrypt.DefaultCost)
 	//fmt.Println(string(s))
 	//$2a$10$iXXY02lkYivkjSs9Hr/MRe/wOw.E0WC0EdLSP9qjQaK6Az9GbCgSm
 	fmt.Println("Starting application")
 	lib.Run()
 
-	fmt.Println("Application is running")
+	fmt.Println("Application stopped")
 
 }
@@ -0,0 +1,169 @@
+package scheduler
+
+import (
+	"Libraria/types"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Store provides the cross-instance lock and remembers how runs went
+type Store interface {
+	TryJobLock(ctx context.Context, name string) (func(), bool, error)
+	LastJobRun(name string) (*time.Time, error)
+	SaveJobRun(run *types.JobRun) error
+}
+
+// Job is a named task repeated every Every give or take the scheduler's jitter
+type Job struct {
+	Name  string
+	Every time.Duration
+	Run   func(ctx context.Context) error
+
+	mu     sync.Mutex
+	status types.JobStatus
+}
+
+// Scheduler runs registered jobs in the background. Every instance keeps its own timers, so with several
+// instances behind a balancer each of them wakes up once per interval. A run first takes a Postgres advisory
+// lock named after the job and, while holding it, checks when the job last finished on any instance, so the
+// job runs once per interval in the whole cluster and never on two instances at the same time
+type Scheduler struct {
+	store    Store
+	instance string
+	// Jitter spreads runs by up to this fraction of the interval so instances do not poll in lockstep
+	Jitter float64
+	jobs   []*Job
+}
+
+func New(store Store) *Scheduler {
+	host, _ := os.Hostname()
+	return &Scheduler{
+		store:    store,
+		instance: fmt.Sprintf("%s/%d", host, os.Getpid()),
+		Jitter:   0.1,
+	}
+}
+
+func (s *Scheduler) Add(name string, every time.Duration, run func(ctx context.Context) error) {
+	job := &Job{Name: name, Every: every, Run: run}
+	job.status = types.JobStatus{Name: name, Interval: every.String()}
+	s.jobs = append(s.jobs, job)
+}
+
+// Run starts every job in its own loop and blocks until ctx is cancelled and the running jobs have returned
+func (s *Scheduler) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, job := range s.jobs {
+		wg.Add(1)
+		go func(job *Job) {
+			defer wg.Done()
+			// the first run is spread as well, otherwise instances started together stay in step
+			timer := time.NewTimer(time.Duration(rand.Float64() * s.Jitter * float64(job.Every)))
+			defer timer.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-timer.C:
+				}
+				s.runJob(ctx, job)
+				timer.Reset(s.next(job.Every))
+			}
+		}(job)
+	}
+	wg.Wait()
+}
+
+// Status reports every job with the counters of this instance
+func (s *Scheduler) Status() []types.JobStatus {
+	statuses := make([]types.JobStatus, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		job.mu.Lock()
+		statuses = append(statuses, job.status)
+		job.mu.Unlock()
+	}
+	return statuses
+}
+
+func (s *Scheduler) next(every time.Duration) time.Duration {
+	return every + time.Duration((rand.Float64()*2-1)*s.Jitter*float64(every))
+}
+
+func (s *Scheduler) runJob(ctx context.Context, job *Job) {
+	unlock, ok, err := s.store.TryJobLock(ctx, job.Name)
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Println("Error while locking job", job.Name+":", err)
+		}
+		return
+	}
+	if !ok {
+		job.mu.Lock()
+		job.status.Skipped++
+		job.mu.Unlock()
+		return
+	}
+	defer unlock()
+
+	// runs are due every Every, the timer may fire up to Jitter early, so only runs younger than
+	// that point back to another instance having done the work already
+	last, err := s.store.LastJobRun(job.Name)
+	if err != nil {
+		fmt.Println("Error while reading last run of job", job.Name+":", err)
+		return
+	}
+	if last != nil && time.Since(*last) < time.Duration((1-s.Jitter)*float64(job.Every)) {
+		job.mu.Lock()
+		job.status.Skipped++
+		job.mu.Unlock()
+		return
+	}
+
+	job.mu.Lock()
+	job.status.Running = true
+	job.mu.Unlock()
+
+	start := time.Now().UTC()
+	err = safeRun(ctx, job)
+	end := time.Now().UTC()
+	run := &types.JobRun{
+		Name:       job.Name,
+		Instance:   s.instance,
+		StartedAt:  start,
+		FinishedAt: end,
+		DurationMs: end.Sub(start).Milliseconds(),
+	}
+	if err != nil {
+		run.Error = err.Error()
+		fmt.Println("Error while running job", job.Name+":", err)
+	}
+
+	job.mu.Lock()
+	job.status.Running = false
+	job.status.Runs++
+	if err != nil {
+		job.status.Failures++
+	}
+	job.status.LastError = run.Error
+	job.status.LastDuration = run.DurationMs
+	job.status.TotalDuration += run.DurationMs
+	job.mu.Unlock()
+
+	if err = s.store.SaveJobRun(run); err != nil {
+		fmt.Println("Error while saving job run", job.Name+":", err)
+	}
+}
+
+// safeRun keeps a panicking job from taking the others down
+func safeRun(ctx context.Context, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return job.Run(ctx)
+}
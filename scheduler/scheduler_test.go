@@ -0,0 +1,143 @@
+package scheduler
+
+import (
+	"Libraria/types"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memoryStore stands in for Postgres, shared by several schedulers it behaves like one database
+type memoryStore struct {
+	mu   sync.Mutex
+	held map[string]bool
+	last map[string]time.Time
+	runs []types.JobRun
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{held: map[string]bool{}, last: map[string]time.Time{}}
+}
+
+func (m *memoryStore) TryJobLock(ctx context.Context, name string) (func(), bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.held[name] {
+		return nil, false, nil
+	}
+	m.held[name] = true
+	return func() {
+		m.mu.Lock()
+		m.held[name] = false
+		m.mu.Unlock()
+	}, true, nil
+}
+
+func (m *memoryStore) LastJobRun(name string) (*time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	last, ok := m.last[name]
+	if !ok {
+		return nil, nil
+	}
+	return &last, nil
+}
+
+func (m *memoryStore) SaveJobRun(run *types.JobRun) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last[run.Name] = run.FinishedAt
+	m.runs = append(m.runs, *run)
+	return nil
+}
+
+func TestSingleLeaderAcrossInstances(t *testing.T) {
+	store := newMemoryStore()
+	var runs int32
+	ctx, cancel := context.WithTimeout(context.Background(), 450*time.Millisecond)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		s := New(store)
+		s.Add("job", 100*time.Millisecond, func(ctx context.Context) error {
+			atomic.AddInt32(&runs, 1)
+			return nil
+		})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Run(ctx)
+		}()
+	}
+	wg.Wait()
+
+	// about 450ms / 100ms, three instances running on their own would give about 13
+	if n := atomic.LoadInt32(&runs); n < 3 || n > 5 {
+		t.Fatalf("job ran %d times across three instances, want 3 to 5", n)
+	}
+}
+
+func TestSingleInstanceKeepsInterval(t *testing.T) {
+	store := newMemoryStore()
+	var runs int32
+	s := New(store)
+	s.Add("job", 50*time.Millisecond, func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 480*time.Millisecond)
+	defer cancel()
+	s.Run(ctx)
+
+	// the jitter window must not make an instance skip its own runs
+	if n := atomic.LoadInt32(&runs); n < 8 {
+		t.Fatalf("job ran %d times, want at least 8", n)
+	}
+	if status := s.Status()[0]; status.Skipped != 0 {
+		t.Fatalf("skipped %d runs, want none", status.Skipped)
+	}
+}
+
+func TestFailuresAndPanicsAreRecorded(t *testing.T) {
+	store := newMemoryStore()
+	s := New(store)
+	s.Add("failing", 20*time.Millisecond, func(ctx context.Context) error {
+		return errors.New("boom")
+	})
+	s.Add("panicking", 20*time.Millisecond, func(ctx context.Context) error {
+		panic("bad")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 70*time.Millisecond)
+	defer cancel()
+	s.Run(ctx)
+
+	for _, status := range s.Status() {
+		if status.Runs == 0 || status.Failures != status.Runs || status.LastError == "" {
+			t.Errorf("%s: %+v", status.Name, status)
+		}
+	}
+	if len(store.runs) == 0 || store.runs[0].Error == "" {
+		t.Fatalf("runs were not saved with their error: %+v", store.runs)
+	}
+}
+
+func TestRunStopsOnCancel(t *testing.T) {
+	s := New(newMemoryStore())
+	s.Add("job", time.Hour, func(ctx context.Context) error { return nil })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+}
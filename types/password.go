@@ -0,0 +1,253 @@
+package types
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// commonPasswordList is only a small built-in baseline. Deployments should point PASSWORD_COMMON_LIST
+// at a real breached-password list, one password per line, it is added on top of this one
+//
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+// PasswordPolicy decides which passwords are accepted and how they are stored
+type PasswordPolicy struct {
+	MinLength  int
+	MaxLength  int
+	MinClasses int
+	Hash       string
+	BcryptCost int
+	Argon2     Argon2Params
+	common     map[string]bool
+}
+
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+var passwordPolicy = DefaultPasswordPolicy()
+
+func DefaultPasswordPolicy() *PasswordPolicy {
+	policy := &PasswordPolicy{
+		MinLength:  8,
+		MaxLength:  64,
+		MinClasses: 2,
+		Hash:       HashBcrypt,
+		BcryptCost: bcrypt.DefaultCost,
+		// OWASP recommended baseline for argon2id
+		Argon2: Argon2Params{Time: 2, Memory: 19 * 1024, Threads: 1, KeyLen: 32, SaltLen: 16},
+		common: map[string]bool{},
+	}
+	policy.addCommon(commonPasswordList)
+	return policy
+}
+
+// LoadPasswordPolicy reads the PASSWORD_* and hashing settings from the environment, unset values keep their defaults
+func LoadPasswordPolicy() error {
+	policy := DefaultPasswordPolicy()
+	ints := map[string]*int{
+		"PASSWORD_MIN_LENGTH":  &policy.MinLength,
+		"PASSWORD_MAX_LENGTH":  &policy.MaxLength,
+		"PASSWORD_MIN_CLASSES": &policy.MinClasses,
+		"BCRYPT_COST":          &policy.BcryptCost,
+	}
+	for name, target := range ints {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", name, value)
+			}
+			*target = n
+		}
+	}
+	uints := map[string]*uint32{
+		"ARGON2_TIME":   &policy.Argon2.Time,
+		"ARGON2_MEMORY": &policy.Argon2.Memory,
+	}
+	for name, target := range uints {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || n == 0 {
+				return fmt.Errorf("invalid %s: %s", name, value)
+			}
+			*target = uint32(n)
+		}
+	}
+	if value := os.Getenv("ARGON2_THREADS"); value != "" {
+		n, err := strconv.ParseUint(value, 10, 8)
+		if err != nil || n == 0 {
+			return fmt.Errorf("invalid ARGON2_THREADS: %s", value)
+		}
+		policy.Argon2.Threads = uint8(n)
+	}
+	if value := os.Getenv("PASSWORD_HASH"); value != "" {
+		if value != HashBcrypt && value != HashArgon2id {
+			return fmt.Errorf("invalid PASSWORD_HASH: %s", value)
+		}
+		policy.Hash = value
+	}
+	// PASSWORD_COMMON_LIST is the file to load a breached-password list from, such as a top passwords dump
+	if path := os.Getenv("PASSWORD_COMMON_LIST"); path != "" {
+		list, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		policy.addCommon(string(list))
+	}
+
+	if policy.MinLength < 1 || policy.MaxLength < policy.MinLength {
+		return fmt.Errorf("invalid password length range %d-%d", policy.MinLength, policy.MaxLength)
+	}
+	if policy.MinClasses < 1 || policy.MinClasses > 4 {
+		return fmt.Errorf("invalid PASSWORD_MIN_CLASSES: %d", policy.MinClasses)
+	}
+	if policy.BcryptCost < bcrypt.MinCost || policy.BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("invalid BCRYPT_COST: %d", policy.BcryptCost)
+	}
+	passwordPolicy = policy
+	return nil
+}
+
+func (policy *PasswordPolicy) addCommon(list string) {
+	scanner := bufio.NewScanner(strings.NewReader(list))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			policy.common[strings.ToLower(line)] = true
+		}
+	}
+}
+
+// ValidatePassword is the password policy shared by accounts and libraries
+func ValidatePassword(password string) error {
+	policy := passwordPolicy
+	length := len([]rune(password))
+	if length < policy.MinLength || length > policy.MaxLength {
+		return fmt.Errorf("password must be %d to %d characters long", policy.MinLength, policy.MaxLength)
+	}
+	// bcrypt ignores everything past 72 bytes
+	if policy.Hash == HashBcrypt && len(password) > 72 {
+		return fmt.Errorf("password is too long")
+	}
+	if classes := characterClasses(password); classes < policy.MinClasses {
+		return fmt.Errorf("password must mix at least %d of lowercase, uppercase, digits and symbols", policy.MinClasses)
+	}
+	if policy.common[strings.ToLower(password)] {
+		return fmt.Errorf("password is too common")
+	}
+	return nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, char := range password {
+		switch {
+		case unicode.IsLower(char):
+			lower = 1
+		case unicode.IsUpper(char):
+			upper = 1
+		case unicode.IsDigit(char):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// HashPassword hashes with the configured algorithm
+func HashPassword(password string) (string, error) {
+	policy := passwordPolicy
+	if policy.Hash == HashArgon2id {
+		params := policy.Argon2
+		salt := make([]byte, params.SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.Memory, params.Time, params.Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), policy.BcryptCost)
+	return string(hash), err
+}
+
+// CheckPassword compares against a bcrypt or argon2id hash, whichever the stored one is
+func CheckPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return false
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// PasswordNeedsRehash tells whether a stored hash was made with another algorithm or weaker parameters than configured
+func PasswordNeedsRehash(hash string) bool {
+	policy := passwordPolicy
+	if strings.HasPrefix(hash, "$argon2id$") {
+		if policy.Hash != HashArgon2id {
+			return true
+		}
+		params, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return true
+		}
+		want := policy.Argon2
+		return params.Time != want.Time || params.Memory != want.Memory || params.Threads != want.Threads ||
+			uint32(len(salt)) != want.SaltLen || uint32(len(key)) != want.KeyLen
+	}
+	if policy.Hash != HashBcrypt {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != policy.BcryptCost
+}
+
+// decodeArgon2 parses the PHC string $argon2id$v=19$m=...,t=...,p=...$salt$key
+func decodeArgon2(hash string) (*Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2 version")
+	}
+	var params Argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, nil, nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return &params, salt, key, nil
+}
@@ -0,0 +1,108 @@
+package types
+
+import (
+	"strings"
+	"testing"
+)
+
+// usePolicy loads the policy from the given environment and restores the previous one after the test
+func usePolicy(t *testing.T, env map[string]string) {
+	t.Helper()
+	previous := passwordPolicy
+	t.Cleanup(func() { passwordPolicy = previous })
+	for _, name := range []string{"PASSWORD_HASH", "BCRYPT_COST", "ARGON2_TIME", "ARGON2_MEMORY", "ARGON2_THREADS",
+		"PASSWORD_MIN_LENGTH", "PASSWORD_MAX_LENGTH", "PASSWORD_MIN_CLASSES", "PASSWORD_COMMON_LIST"} {
+		t.Setenv(name, env[name])
+	}
+	if err := LoadPasswordPolicy(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var (
+	cheapBcrypt = map[string]string{"PASSWORD_HASH": HashBcrypt, "BCRYPT_COST": "4"}
+	cheapArgon2 = map[string]string{"PASSWORD_HASH": HashArgon2id, "ARGON2_TIME": "1", "ARGON2_MEMORY": "64"}
+)
+
+func TestHashAndCheck(t *testing.T) {
+	for name, env := range map[string]map[string]string{HashBcrypt: cheapBcrypt, HashArgon2id: cheapArgon2} {
+		usePolicy(t, env)
+		hash, err := HashPassword("correct horse 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == HashArgon2id && !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+			t.Errorf("argon2id hash %q does not carry its parameters", hash)
+		}
+		if !CheckPassword(hash, "correct horse 1") {
+			t.Errorf("%s: the right password was refused", name)
+		}
+		if CheckPassword(hash, "correct horse 2") {
+			t.Errorf("%s: a wrong password was accepted", name)
+		}
+		if PasswordNeedsRehash(hash) {
+			t.Errorf("%s: a fresh hash should not need a rehash", name)
+		}
+		other, _ := HashPassword("correct horse 1")
+		if other == hash {
+			t.Errorf("%s: hashes are not salted", name)
+		}
+	}
+}
+
+func TestCheckRejectsBrokenHashes(t *testing.T) {
+	for _, hash := range []string{"", "plain", "$argon2id$v=19$m=64,t=1,p=1$!!$!!", "$argon2id$v=18$m=64,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=19$broken"} {
+		if CheckPassword(hash, "anything") {
+			t.Errorf("%q was accepted", hash)
+		}
+	}
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	usePolicy(t, cheapBcrypt)
+	bcryptHash, _ := HashPassword("correct horse 1")
+	usePolicy(t, cheapArgon2)
+	argonHash, _ := HashPassword("correct horse 1")
+
+	// switching algorithms upgrades old hashes on the next login, in both directions
+	if !PasswordNeedsRehash(bcryptHash) {
+		t.Error("a bcrypt hash should be rehashed once argon2id is configured")
+	}
+	usePolicy(t, cheapBcrypt)
+	if !PasswordNeedsRehash(argonHash) {
+		t.Error("an argon2id hash should be rehashed once bcrypt is configured")
+	}
+
+	usePolicy(t, map[string]string{"PASSWORD_HASH": HashBcrypt, "BCRYPT_COST": "5"})
+	if !PasswordNeedsRehash(bcryptHash) {
+		t.Error("a raised bcrypt cost should trigger a rehash")
+	}
+	usePolicy(t, map[string]string{"PASSWORD_HASH": HashArgon2id, "ARGON2_TIME": "2", "ARGON2_MEMORY": "64"})
+	if !PasswordNeedsRehash(argonHash) {
+		t.Error("raised argon2id parameters should trigger a rehash")
+	}
+	if !PasswordNeedsRehash("$argon2id$garbage") || !PasswordNeedsRehash("garbage") {
+		t.Error("an unreadable hash should be replaced")
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	usePolicy(t, nil)
+	tests := []struct {
+		password string
+		ok       bool
+	}{
+		{"short1", false},
+		{"onlyletters", false},
+		{"12345678901", false},
+		{"letters4and", true},
+		{"Password1", false},
+		{strings.Repeat("a1", 33), false},
+		{"мойпароль7", true},
+	}
+	for _, tt := range tests {
+		if err := ValidatePassword(tt.password); (err == nil) != tt.ok {
+			t.Errorf("ValidatePassword(%q) = %v, want ok %v", tt.password, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package types
+
+import "slices"
+
+const (
+	PrincipalUser    = "user"
+	PrincipalLibrary = "library"
+	PrincipalAdmin   = "admin"
+)
+
+// Principal is the authenticated party behind a request
+type Principal struct {
+	SubjectID uint     `json:"subjectID"`
+	Kind      string   `json:"kind"`
+	Roles     []string `json:"roles"`
+	SessionID string   `json:"sid"`
+	APIKeyID  uint     `json:"apiKeyID,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+}
+
+func NewAccountPrincipal(account *Account) *Principal {
+	if account.Role == RoleAdmin {
+		return &Principal{SubjectID: account.ID, Kind: PrincipalAdmin, Roles: []string{RolePatron, RoleAdmin}}
+	}
+	return &Principal{SubjectID: account.ID, Kind: PrincipalUser, Roles: []string{RolePatron}}
+}
+
+func NewLibraryPrincipal(library *LibraryAccount) *Principal {
+	return &Principal{SubjectID: library.ID, Kind: PrincipalLibrary, Roles: []string{RoleLibrary}}
+}
+
+// NewAPIKeyPrincipal acts for the library owning the key, limited to the key's scope
+func NewAPIKeyPrincipal(key *APIKey) *Principal {
+	return &Principal{SubjectID: key.LibraryID, Kind: PrincipalLibrary, Roles: []string{RoleLibrary}, APIKeyID: key.ID, Scope: key.Scope}
+}
+
+func (principal *Principal) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if slices.Contains(principal.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAccount tells whether the principal is a patron account, admins included
+func (principal *Principal) IsAccount() bool {
+	return principal.Kind == PrincipalUser || principal.Kind == PrincipalAdmin
+}
+
+func (principal *Principal) IsLibrary() bool {
+	return principal.Kind == PrincipalLibrary
+}
+
+func (principal *Principal) SessionKind() string {
+	if principal.IsLibrary() {
+		return SessionLibrary
+	}
+	return SessionAccount
+}
+
+func (principal *Principal) IsAPIKey() bool {
+	return principal.APIKeyID != 0
+}
+
+// HasScope tells whether an API key may perform a scoped write, every key may read
+func (principal *Principal) HasScope(scope string) bool {
+	return principal.IsAPIKey() && principal.Scope == scope
+}
@@ -0,0 +1,33 @@
+package types
+
+import "time"
+
+// RateLimit describes a token bucket holding up to Burst tokens and gaining one token every Every
+type RateLimit struct {
+	Burst float64
+	Every time.Duration
+}
+
+// Refill returns how many tokens a bucket holding tokens has after elapsed time
+func (l RateLimit) Refill(tokens float64, elapsed time.Duration) float64 {
+	tokens += elapsed.Seconds() / l.Every.Seconds()
+	if tokens > l.Burst {
+		return l.Burst
+	}
+	return tokens
+}
+
+// Wait returns how long a bucket holding tokens has to wait for the next whole token
+func (l RateLimit) Wait(tokens float64) time.Duration {
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tokens) * float64(l.Every))
+}
+
+// Lockout closes logins for an email after MaxFailures failed attempts within Window
+type Lockout struct {
+	MaxFailures int
+	Window      time.Duration
+	Duration    time.Duration
+}
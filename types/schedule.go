@@ -0,0 +1,143 @@
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// Opening hours are wall-clock "HH:MM" values in the server's local time zone,
+// a closing time at or before the opening time falls on the next day
+const clockLayout = "15:04"
+
+type OpeningHours struct {
+	Weekday int    `json:"weekday"`
+	Opens   string `json:"opens"`
+	Closes  string `json:"closes"`
+}
+
+type ScheduleException struct {
+	Date   string `json:"date"`
+	Closed bool   `json:"closed"`
+	Opens  string `json:"opens"`
+	Closes string `json:"closes"`
+	Note   string `json:"note"`
+}
+
+type LibrarySchedule struct {
+	Weekly     []OpeningHours      `json:"weekly"`
+	Exceptions []ScheduleException `json:"exceptions"`
+}
+
+type LibraryHours struct {
+	LibraryWeb
+	OpenNow     bool             `json:"openNow"`
+	NextOpening *time.Time       `json:"nextOpening"`
+	Schedule    *LibrarySchedule `json:"schedule,omitempty"`
+}
+
+func validHours(opens, closes string) bool {
+	o, err := time.Parse(clockLayout, opens)
+	if err != nil {
+		return false
+	}
+	c, err := time.Parse(clockLayout, closes)
+	if err != nil {
+		return false
+	}
+	return !o.Equal(c)
+}
+
+func (schedule *LibrarySchedule) ValidateSchedule() error {
+	days := map[int]bool{}
+	for _, hours := range schedule.Weekly {
+		if hours.Weekday < 0 || hours.Weekday > 6 || days[hours.Weekday] {
+			return fmt.Errorf("invalid weekday %d", hours.Weekday)
+		}
+		days[hours.Weekday] = true
+		if !validHours(hours.Opens, hours.Closes) {
+			return fmt.Errorf("invalid hours %s-%s", hours.Opens, hours.Closes)
+		}
+	}
+	dates := map[string]bool{}
+	for _, exception := range schedule.Exceptions {
+		if _, err := time.Parse("2006-01-02", exception.Date); err != nil || dates[exception.Date] {
+			return fmt.Errorf("invalid date %s", exception.Date)
+		}
+		dates[exception.Date] = true
+		if !exception.Closed && !validHours(exception.Opens, exception.Closes) {
+			return fmt.Errorf("invalid hours %s-%s", exception.Opens, exception.Closes)
+		}
+		if len(exception.Note) > 100 {
+			return fmt.Errorf("invalid note")
+		}
+	}
+	return nil
+}
+
+// HasHours reports whether the library published any opening hours at all
+func (schedule *LibrarySchedule) HasHours() bool {
+	return schedule != nil && len(schedule.Weekly) > 0
+}
+
+// hoursOn returns the opening and closing moments of the given day, exceptions taking priority
+func (schedule *LibrarySchedule) hoursOn(day time.Time) (time.Time, time.Time, bool) {
+	day = day.In(time.Local)
+	opens, closes := "", ""
+	for _, hours := range schedule.Weekly {
+		if hours.Weekday == int(day.Weekday()) {
+			opens, closes = hours.Opens, hours.Closes
+		}
+	}
+	for _, exception := range schedule.Exceptions {
+		if exception.Date != day.Format("2006-01-02") {
+			continue
+		}
+		if exception.Closed {
+			return time.Time{}, time.Time{}, false
+		}
+		opens, closes = exception.Opens, exception.Closes
+	}
+	if opens == "" {
+		return time.Time{}, time.Time{}, false
+	}
+	o, _ := time.Parse(clockLayout, opens)
+	c, _ := time.Parse(clockLayout, closes)
+	closeDay := day.Day()
+	if !c.After(o) {
+		closeDay++
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), o.Hour(), o.Minute(), 0, 0, time.Local),
+		time.Date(day.Year(), day.Month(), closeDay, c.Hour(), c.Minute(), 0, 0, time.Local), true
+}
+
+// Status tells whether the library is open at t and, if not, when it opens next
+func (schedule *LibrarySchedule) Status(t time.Time) (bool, *time.Time) {
+	if !schedule.HasHours() {
+		return false, nil
+	}
+	// the day before is looked at too, its hours may run past midnight
+	for i := -1; i < 60; i++ {
+		opens, closes, ok := schedule.hoursOn(t.AddDate(0, 0, i))
+		if !ok || !t.Before(closes) {
+			continue
+		}
+		if !t.Before(opens) {
+			return true, nil
+		}
+		return false, &opens
+	}
+	return false, nil
+}
+
+// NextOpenDay moves t forward to the first day the library is open
+func (schedule *LibrarySchedule) NextOpenDay(t time.Time) time.Time {
+	if !schedule.HasHours() {
+		return t
+	}
+	for i := 0; i < 60; i++ {
+		if _, _, ok := schedule.hoursOn(t.AddDate(0, 0, i)); ok {
+			return t.AddDate(0, 0, i)
+		}
+	}
+	return t
+}
@@ -0,0 +1,127 @@
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+// useLocal makes loc the server's time zone for the test
+func useLocal(t *testing.T, loc *time.Location) {
+	t.Helper()
+	previous := time.Local
+	t.Cleanup(func() { time.Local = previous })
+	time.Local = loc
+}
+
+// testSchedule opens weekdays 9-18 with late Friday hours past midnight, Saturday mornings and
+// never on Sunday. New Year's Day is a holiday and the Friday after it has short hours
+var testSchedule = &LibrarySchedule{
+	Weekly: []OpeningHours{
+		{Weekday: 1, Opens: "09:00", Closes: "18:00"},
+		{Weekday: 2, Opens: "09:00", Closes: "18:00"},
+		{Weekday: 3, Opens: "09:00", Closes: "18:00"},
+		{Weekday: 4, Opens: "09:00", Closes: "18:00"},
+		{Weekday: 5, Opens: "18:00", Closes: "02:00"},
+		{Weekday: 6, Opens: "10:00", Closes: "14:00"},
+	},
+	Exceptions: []ScheduleException{
+		{Date: "2026-01-01", Closed: true, Note: "New Year"},
+		{Date: "2026-01-02", Opens: "10:00", Closes: "12:00"},
+	},
+}
+
+func localTime(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.ParseInLocation("2006-01-02 15:04", value, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestScheduleStatus(t *testing.T) {
+	useLocal(t, time.FixedZone("UTC+3", 3*60*60))
+	utc := func(value string) time.Time {
+		parsed, _ := time.Parse("2006-01-02 15:04", value)
+		return parsed
+	}
+	tests := []struct {
+		name     string
+		at       time.Time
+		wantOpen bool
+		wantNext string
+	}{
+		{"before opening", localTime(t, "2026-01-05 08:00"), false, "2026-01-05 09:00"},
+		{"during the day", localTime(t, "2026-01-05 12:00"), true, ""},
+		{"at closing", localTime(t, "2026-01-05 18:00"), false, "2026-01-06 09:00"},
+		{"overnight before midnight", localTime(t, "2026-01-09 23:00"), true, ""},
+		{"overnight after midnight", localTime(t, "2026-01-10 01:30"), true, ""},
+		{"after the overnight close", localTime(t, "2026-01-10 02:00"), false, "2026-01-10 10:00"},
+		{"closed Sunday", localTime(t, "2026-01-11 12:00"), false, "2026-01-12 09:00"},
+		{"week wraps after Saturday", localTime(t, "2026-01-10 15:00"), false, "2026-01-12 09:00"},
+		{"holiday", localTime(t, "2026-01-01 12:00"), false, "2026-01-02 10:00"},
+		{"year wraps into the holiday", localTime(t, "2025-12-31 18:30"), false, "2026-01-02 10:00"},
+		{"short hours replace the overnight ones", localTime(t, "2026-01-02 23:00"), false, "2026-01-03 10:00"},
+		{"UTC time inside local hours", utc("2026-01-05 06:30"), true, ""},
+		{"UTC time before local hours", utc("2026-01-05 05:30"), false, "2026-01-05 09:00"},
+	}
+	for _, tt := range tests {
+		open, next := testSchedule.Status(tt.at)
+		if open != tt.wantOpen {
+			t.Errorf("%s: open %v, want %v", tt.name, open, tt.wantOpen)
+		}
+		switch {
+		case tt.wantNext == "" && next != nil:
+			t.Errorf("%s: next opening %v, want none", tt.name, next)
+		case tt.wantNext != "" && (next == nil || !next.Equal(localTime(t, tt.wantNext))):
+			t.Errorf("%s: next opening %v, want %s", tt.name, next, tt.wantNext)
+		}
+	}
+
+	if open, next := (&LibrarySchedule{}).Status(localTime(t, "2026-01-05 12:00")); open || next != nil {
+		t.Errorf("a library without hours is open %v, next %v", open, next)
+	}
+}
+
+func TestScheduleNextOpenDay(t *testing.T) {
+	useLocal(t, time.FixedZone("UTC+3", 3*60*60))
+	tests := []struct {
+		name string
+		from time.Time
+		want time.Time
+	}{
+		{"open weekday", localTime(t, "2026-01-05 10:00"), localTime(t, "2026-01-05 10:00")},
+		{"Saturday after closing is still an open day", localTime(t, "2026-01-10 20:00"), localTime(t, "2026-01-10 20:00")},
+		{"closed Sunday", localTime(t, "2026-01-11 10:00"), localTime(t, "2026-01-12 10:00")},
+		{"holiday", localTime(t, "2026-01-01 10:00"), localTime(t, "2026-01-02 10:00")},
+		{"UTC time on a local Sunday", time.Date(2026, 1, 10, 22, 0, 0, 0, time.UTC), localTime(t, "2026-01-12 01:00")},
+	}
+	for _, tt := range tests {
+		if got := testSchedule.NextOpenDay(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	from := localTime(t, "2026-01-11 10:00")
+	if got := (&LibrarySchedule{}).NextOpenDay(from); !got.Equal(from) {
+		t.Errorf("a library without hours moved the day to %v", got)
+	}
+}
+
+func TestValidateScheduleHours(t *testing.T) {
+	tests := []struct {
+		opens, closes string
+		valid         bool
+	}{
+		{"09:00", "18:00", true},
+		{"18:00", "02:00", true},
+		{"09:00", "09:00", false},
+		{"9am", "18:00", false},
+	}
+	for _, tt := range tests {
+		schedule := &LibrarySchedule{Weekly: []OpeningHours{{Weekday: 1, Opens: tt.opens, Closes: tt.closes}}}
+		if err := schedule.ValidateSchedule(); (err == nil) != tt.valid {
+			t.Errorf("%s-%s: got %v, want valid %v", tt.opens, tt.closes, err, tt.valid)
+		}
+	}
+}
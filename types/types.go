@@ -2,7 +2,6 @@ package types
 
 import (
 	"fmt"
-	"golang.org/x/crypto/bcrypt"
 	"regexp"
 	"time"
 	"unicode"
@@ -31,12 +30,19 @@ type LibRequest struct {
 	ExpiresAt     time.Time `json:"expires_at"`
 }
 
+const (
+	RolePatron  = "patron"
+	RoleLibrary = "library"
+	RoleAdmin   = "admin"
+)
+
 type Account struct {
 	ID        uint   `json:"id"`
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
 	Password  string `json:"password"`
 	Email     string `json:"email"`
+	Role      string `json:"role"`
 }
 
 type LibraryAccount struct {
@@ -60,6 +66,47 @@ type LibraryWeb struct {
 	Longitude     float32 `json:"longitude"`
 }
 
+const (
+	SessionAccount = "account"
+	SessionLibrary = "library"
+)
+
+type Session struct {
+	ID           string     `json:"id"`
+	Kind         string     `json:"kind"`
+	SubjectID    uint       `json:"subjectID"`
+	RefreshHash  string     `json:"-"`
+	PreviousHash string     `json:"-"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	ExpiresAt    time.Time  `json:"expiresAt"`
+	RotatedAt    *time.Time `json:"rotatedAt"`
+	RevokedAt    *time.Time `json:"revokedAt"`
+}
+
+const (
+	ScopeRead           = "read"
+	ScopeInventoryWrite = "inventory:write"
+)
+
+// APIKey lets a library script the API, only the hash of the key is stored
+type APIKey struct {
+	ID         uint       `json:"id"`
+	LibraryID  uint       `json:"libraryID"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Hash       string     `json:"-"`
+	Scope      string     `json:"scope"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+}
+
+// NewAPIKey is the only response that carries the key itself
+type NewAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
 type LoginRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
@@ -72,11 +119,33 @@ type PasswordResetRequest struct {
 	ExpiresAt time.Time `json:"expiresAt"`
 }
 
+// EmailChangeRequest holds a new login address until it is confirmed from its inbox
+type EmailChangeRequest struct {
+	ID        uint      `json:"id"`
+	Kind      string    `json:"kind"`
+	SubjectID uint      `json:"subjectID"`
+	OldEmail  string    `json:"oldEmail"`
+	Email     string    `json:"email"`
+	Tag       string    `json:"tag"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type EmailChange struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
 type NewPassword struct {
 	NewPassword        string `json:"newPassword"`
 	NewPasswordConfirm string `json:"newPasswordConfirm"`
 }
 
+type PasswordChange struct {
+	CurrentPassword    string `json:"currentPassword"`
+	NewPassword        string `json:"newPassword"`
+	NewPasswordConfirm string `json:"newPasswordConfirm"`
+}
+
 type Book struct {
 	ID          uint   `json:"id"`
 	Name        string `json:"name"`
@@ -87,12 +156,183 @@ type Book struct {
 	Language    string `json:"language"`
 }
 
+type SearchParams struct {
+	Input     string `json:"inputValue"`
+	Genre     string `json:"genre"`
+	Language  string `json:"language"`
+	Author    string `json:"author"`
+	YearFrom  uint   `json:"yearFrom"`
+	YearTo    uint   `json:"yearTo"`
+	LibraryID uint   `json:"libraryID"`
+	Sort      string `json:"sort"`
+	Limit     uint   `json:"limit"`
+	Offset    uint   `json:"offset"`
+}
+
+type FacetCount struct {
+	ID    uint   `json:"id,omitempty"`
+	Value string `json:"value"`
+	Count uint   `json:"count"`
+}
+
+type SearchResult struct {
+	Books       []Book                  `json:"books"`
+	Libraries   []LibraryWeb            `json:"libraries"`
+	Facets      map[string][]FacetCount `json:"facets"`
+	Suggestions []string                `json:"suggestions"`
+	Total       uint                    `json:"total"`
+	Limit       uint                    `json:"limit"`
+	Offset      uint                    `json:"offset"`
+}
+
+type Suggestion struct {
+	Value string `json:"value"`
+	Kind  string `json:"kind"`
+}
+
 type LibraryBook struct {
 	BookID    uint `json:"bookID"`
 	LibraryID uint `json:"libraryID"`
 	Amount    uint `json:"amount"`
 }
 
+type LibraryHolding struct {
+	LibraryWeb
+	Available uint            `json:"available"`
+	Items     map[string]uint `json:"items,omitempty"`
+}
+
+type NearbyLibrary struct {
+	LibraryWeb
+	Distance float64 `json:"distance"`
+}
+
+type NearbyHolding struct {
+	LibraryHolding
+	Distance float64 `json:"distance"`
+}
+
+type BookHolding struct {
+	Book
+	Available uint `json:"available"`
+}
+
+const (
+	ItemAvailable = "available"
+	ItemOnLoan    = "on_loan"
+	ItemLost      = "lost"
+	ItemRepair    = "repair"
+)
+
+type Item struct {
+	ID        uint      `json:"id"`
+	BookID    uint      `json:"bookID"`
+	LibraryID uint      `json:"libraryID"`
+	Barcode   string    `json:"barcode"`
+	Condition string    `json:"condition"`
+	Shelf     string    `json:"shelf"`
+	Status    string    `json:"status"`
+	AddedAt   time.Time `json:"addedAt"`
+}
+
+type Loan struct {
+	ID          uint       `json:"id"`
+	BookID      uint       `json:"bookID"`
+	LibraryID   uint       `json:"libraryID"`
+	UserID      uint       `json:"userID"`
+	ItemID      uint       `json:"itemID,omitempty"`
+	BookName    string     `json:"bookName"`
+	LibraryName string     `json:"libraryName"`
+	IssuedAt    time.Time  `json:"issuedAt"`
+	DueAt       time.Time  `json:"dueAt"`
+	ReturnedAt  *time.Time `json:"returnedAt"`
+}
+
+const (
+	HoldWaiting   = "waiting"
+	HoldReady     = "ready"
+	HoldFulfilled = "fulfilled"
+	HoldExpired   = "expired"
+	HoldCancelled = "cancelled"
+)
+
+type Hold struct {
+	ID          uint       `json:"id"`
+	BookID      uint       `json:"bookID"`
+	LibraryID   uint       `json:"libraryID"`
+	UserID      uint       `json:"userID"`
+	BookName    string     `json:"bookName"`
+	LibraryName string     `json:"libraryName"`
+	Status      string     `json:"status"`
+	Position    uint       `json:"position"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ReadyAt     *time.Time `json:"readyAt"`
+	ExpiresAt   *time.Time `json:"expiresAt"`
+}
+
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxDead    = "dead"
+)
+
+// OutboxMessage is an email saved together with the row that triggered it and delivered later by the outbox worker
+type OutboxMessage struct {
+	ID            uint       `json:"id"`
+	Recipient     string     `json:"recipient"`
+	Subject       string     `json:"subject"`
+	Body          string     `json:"-"` // carries live confirmation and reset links, never shown
+	HTML          string     `json:"-"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"nextAttemptAt"`
+	LastError     string     `json:"lastError"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	SentAt        *time.Time `json:"sentAt"`
+	ExpiresAt     *time.Time `json:"expiresAt"`
+	Locale        string     `json:"locale"`
+}
+
+// LocaleSettings is the language emails are written in, Locales lists the ones available
+type LocaleSettings struct {
+	Locale  string   `json:"locale"`
+	Locales []string `json:"locales,omitempty"`
+}
+
+// JobRun is the latest run of a background job, whichever instance held the lock
+type JobRun struct {
+	Name          string     `json:"name"`
+	Instance      string     `json:"instance"`
+	StartedAt     time.Time  `json:"startedAt"`
+	FinishedAt    time.Time  `json:"finishedAt"`
+	DurationMs    int64      `json:"durationMs"`
+	Error         string     `json:"error"`
+	Runs          int        `json:"runs"`
+	Failures      int        `json:"failures"`
+	LastSuccessAt *time.Time `json:"lastSuccessAt"`
+}
+
+// JobStatus is what admins see for a job, the counters belong to the instance that answered
+type JobStatus struct {
+	Name          string  `json:"name"`
+	Interval      string  `json:"interval"`
+	Running       bool    `json:"running"`
+	Runs          int     `json:"runs"`
+	Failures      int     `json:"failures"`
+	Skipped       int     `json:"skipped"`
+	LastDuration  int64   `json:"lastDurationMs"`
+	TotalDuration int64   `json:"totalDurationMs"`
+	LastError     string  `json:"lastError"`
+	LastRun       *JobRun `json:"lastRun"`
+}
+
+type CheckoutRequest struct {
+	BookID  uint   `json:"bookID"`
+	Barcode string `json:"barcode"`
+	Email   string `json:"email"`
+	Days    uint   `json:"days"`
+}
+
 func (lib *LibraryAccount) ConvertToWeb() (webLibs *LibraryWeb) {
 	return &LibraryWeb{
 		ID:            lib.ID,
@@ -105,12 +345,12 @@ func (lib *LibraryAccount) ConvertToWeb() (webLibs *LibraryWeb) {
 	}
 }
 
-func (book *Book) Pointers() (*uint, *string, *string, *uint, *string, *string) {
-	return &book.ID, &book.Name, &book.Author, &book.Year, &book.Genre, &book.Description
+func (book *Book) Pointers() (*uint, *string, *string, *uint, *string, *string, *string) {
+	return &book.ID, &book.Name, &book.Author, &book.Year, &book.Genre, &book.Description, &book.Language
 }
 
-func (account *Account) Pointers() (*uint, *string, *string, *string, *string) {
-	return &account.ID, &account.FirstName, &account.LastName, &account.Password, &account.Email
+func (account *Account) Pointers() (*uint, *string, *string, *string, *string, *string) {
+	return &account.ID, &account.FirstName, &account.LastName, &account.Password, &account.Email, &account.Role
 }
 
 func (account *UserRequest) Pointers() (*uint, *string, *string, *string, *string, *string, *time.Time) {
@@ -125,29 +365,118 @@ func (library *LibRequest) Pointers() (*uint, *string, *string, *string, *string
 	return &library.ID, &library.Name, &library.Email, &library.Password, &library.Address, &library.ContactNumber, &library.Latitude, &library.Longitude, &library.Tag, &library.ExpiresAt
 }
 
+func (session *Session) Pointers() (*string, *string, *uint, *string, *string, *time.Time, *time.Time, **time.Time, **time.Time) {
+	return &session.ID, &session.Kind, &session.SubjectID, &session.RefreshHash, &session.PreviousHash, &session.CreatedAt, &session.ExpiresAt, &session.RotatedAt, &session.RevokedAt
+}
+
+func (key *APIKey) Pointers() (*uint, *uint, *string, *string, *string, *time.Time, **time.Time, **time.Time) {
+	return &key.ID, &key.LibraryID, &key.Name, &key.Prefix, &key.Scope, &key.CreatedAt, &key.LastUsedAt, &key.RevokedAt
+}
+
+func (request *EmailChangeRequest) Pointers() (*uint, *string, *uint, *string, *string, *string, *time.Time) {
+	return &request.ID, &request.Kind, &request.SubjectID, &request.OldEmail, &request.Email, &request.Tag, &request.ExpiresAt
+}
+
+func (message *OutboxMessage) Pointers() (*uint, *string, *string, *string, *string, *string, *int, *time.Time, *string, *time.Time, **time.Time, **time.Time, *string) {
+	return &message.ID, &message.Recipient, &message.Subject, &message.Body, &message.HTML, &message.Status, &message.Attempts, &message.NextAttemptAt, &message.LastError, &message.CreatedAt, &message.SentAt, &message.ExpiresAt, &message.Locale
+}
+
+func (run *JobRun) Pointers() (*string, *string, *time.Time, *time.Time, *int64, *string, *int, *int, **time.Time) {
+	return &run.Name, &run.Instance, &run.StartedAt, &run.FinishedAt, &run.DurationMs, &run.Error, &run.Runs, &run.Failures, &run.LastSuccessAt
+}
+
+func (item *Item) Pointers() (*uint, *uint, *uint, *string, *string, *string, *string, *time.Time) {
+	return &item.ID, &item.BookID, &item.LibraryID, &item.Barcode, &item.Condition, &item.Shelf, &item.Status, &item.AddedAt
+}
+
+func (loan *Loan) Pointers() (*uint, *uint, *uint, *uint, *uint, *string, *string, *time.Time, *time.Time, **time.Time) {
+	return &loan.ID, &loan.BookID, &loan.LibraryID, &loan.UserID, &loan.ItemID, &loan.BookName, &loan.LibraryName, &loan.IssuedAt, &loan.DueAt, &loan.ReturnedAt
+}
+
+func (hold *Hold) Pointers() (*uint, *uint, *uint, *uint, *string, *string, *string, *uint, *time.Time, **time.Time, **time.Time) {
+	return &hold.ID, &hold.BookID, &hold.LibraryID, &hold.UserID, &hold.BookName, &hold.LibraryName, &hold.Status, &hold.Position, &hold.CreatedAt, &hold.ReadyAt, &hold.ExpiresAt
+}
+
+func (item *Item) ValidateItem() error {
+	if len(item.Barcode) == 0 || len(item.Barcode) > 50 || !containsLetterAndDigits(item.Barcode) {
+		return fmt.Errorf("invalid barcode")
+	}
+	if len(item.Condition) > 50 {
+		return fmt.Errorf("invalid condition")
+	}
+	if len(item.Shelf) > 50 {
+		return fmt.Errorf("invalid shelf location")
+	}
+	switch item.Status {
+	case ItemAvailable, ItemLost, ItemRepair:
+	default:
+		return fmt.Errorf("invalid status %s", item.Status)
+	}
+	return nil
+}
+
+func (change *EmailChange) ValidateEmailChange() error {
+	if len(change.Email) == 0 || len(change.Email) > 50 || !isValidEmail(change.Email) {
+		return fmt.Errorf("invalid email")
+	}
+	return nil
+}
+
+func (key *APIKey) ValidateAPIKey() error {
+	if len(key.Name) == 0 || len(key.Name) > 50 {
+		return fmt.Errorf("invalid key name")
+	}
+	switch key.Scope {
+	case ScopeRead, ScopeInventoryWrite:
+	default:
+		return fmt.Errorf("invalid scope %s", key.Scope)
+	}
+	return nil
+}
+
+func (params *SearchParams) ValidateSearch() error {
+	switch params.Sort {
+	case "":
+		params.Sort = "relevance"
+	case "relevance", "year", "title", "popularity":
+	default:
+		return fmt.Errorf("invalid sort %s", params.Sort)
+	}
+	if params.YearFrom > 0 && params.YearTo > 0 && params.YearFrom > params.YearTo {
+		return fmt.Errorf("invalid year range")
+	}
+	if params.Limit == 0 {
+		params.Limit = 20
+	}
+	if params.Limit > 100 {
+		params.Limit = 100
+	}
+	return nil
+}
+
 func (account *Account) ValidPassword(pw string) bool {
-	return bcrypt.CompareHashAndPassword([]byte(account.Password), []byte(pw)) == nil
+	return CheckPassword(account.Password, pw)
 }
 
 func (library *LibraryAccount) ValidPassword(pw string) bool {
-	return bcrypt.CompareHashAndPassword([]byte(library.Password), []byte(pw)) == nil
+	return CheckPassword(library.Password, pw)
 }
 
 func (account *Account) PasswordHash() error {
-	encpw, err := bcrypt.GenerateFromPassword([]byte(account.Password), bcrypt.DefaultCost)
+	encpw, err := HashPassword(account.Password)
 	if err != nil {
 		return err
 	}
-	account.Password = string(encpw)
+	account.Password = encpw
 	return nil
 }
 
 func (library *LibraryAccount) PasswordHash() error {
-	encpw, err := bcrypt.GenerateFromPassword([]byte(library.Password), bcrypt.DefaultCost)
+	encpw, err := HashPassword(library.Password)
 	if err != nil {
 		return err
 	}
-	library.Password = string(encpw)
+	library.Password = encpw
 	return nil
 }
 
@@ -185,8 +514,8 @@ func (account *Account) ValidateAccount() error {
 	if len(account.Email) == 0 || len(account.Email) > 50 || !isValidEmail(account.Email) {
 		return fmt.Errorf("invalid email")
 	}
-	if len(account.Password) < 8 || len(account.Password) > 20 || !containsLetterAndDigits(account.Password) {
-		return fmt.Errorf("invalid password")
+	if err := ValidatePassword(account.Password); err != nil {
+		return err
 	}
 	if len(account.FirstName) == 0 || len(account.FirstName) > 15 || !containsLetters(account.FirstName) {
 		return fmt.Errorf("invalid first name")
@@ -200,8 +529,8 @@ func (library *LibraryAccount) ValidateAccount() error {
 	if len(library.Email) == 0 || len(library.Email) > 50 || !isValidEmail(library.Email) {
 		return fmt.Errorf("invalid email")
 	}
-	if len(library.Password) < 8 || len(library.Password) > 20 || !containsLetterAndDigits(library.Password) {
-		return fmt.Errorf("invalid password")
+	if err := ValidatePassword(library.Password); err != nil {
+		return err
 	}
 	if len(library.Name) == 0 || len(library.Name) > 50 || !containsLetters(library.Name) {
 		return fmt.Errorf("invalid first name")
@@ -220,3 +549,87 @@ func (library *LibraryAccount) ValidateAccount() error {
 	}
 	return nil
 }
+
+// TwoFactor is the TOTP enrollment of an account or library, it only guards logins once enabled
+type TwoFactor struct {
+	Kind      string `json:"kind"`
+	SubjectID uint   `json:"subjectID"`
+	Secret    string `json:"-"`
+	Enabled   bool   `json:"enabled"`
+	LastStep  int64  `json:"-"`
+}
+
+// LoginChallenge is a login that passed the password check and waits for the second factor
+type LoginChallenge struct {
+	ID        string    `json:"-"`
+	Kind      string    `json:"kind"`
+	SubjectID uint      `json:"subjectID"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TwoFactorRequest struct {
+	Code string `json:"code"`
+}
+
+// OIDCLogin is a single sign-on attempt waiting for the identity provider to redirect back
+type OIDCLogin struct {
+	State     string    `json:"-"`
+	Verifier  string    `json:"-"`
+	Nonce     string    `json:"-"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// AccountDeletion waits for the owner to confirm the deletion from their inbox
+type AccountDeletion struct {
+	ID        uint      `json:"id"`
+	AccountID uint      `json:"accountID"`
+	Tag       string    `json:"tag"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type BookVisit struct {
+	BookID   uint      `json:"bookID"`
+	BookName string    `json:"bookName"`
+	Time     time.Time `json:"time"`
+}
+
+type LinkedIdentity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// AccountExport is everything stored about an account, secrets and hashes left out
+type AccountExport struct {
+	ExportedAt       time.Time            `json:"exportedAt"`
+	Account          Account              `json:"account"`
+	LastBooks        []BookVisit          `json:"lastBooks"`
+	Loans            []Loan               `json:"loans"`
+	Holds            []Hold               `json:"holds"`
+	Sessions         []Session            `json:"sessions"`
+	TwoFactorEnabled bool                 `json:"twoFactorEnabled"`
+	Locale           string               `json:"locale"`
+	Identities       []LinkedIdentity     `json:"identities"`
+	EmailChanges     []EmailChangeRequest `json:"emailChanges"`
+	Emails           []OutboxMessage      `json:"emails"`
+}
+
+// Redact clears the secrets an export must not carry: the password hash, session token hashes,
+// email change links and the bodies of queued emails, which hold live links as well
+func (export *AccountExport) Redact() {
+	export.Account.Password = ""
+	for i := range export.Sessions {
+		export.Sessions[i].RefreshHash, export.Sessions[i].PreviousHash = "", ""
+	}
+	for i := range export.EmailChanges {
+		export.EmailChanges[i].Tag = ""
+	}
+	for i := range export.Emails {
+		export.Emails[i].Body, export.Emails[i].HTML = "", ""
+	}
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	earthRadiusKm = 6371.0
+	defaultRadius = 10.0
+	maxRadius     = 500.0
+)
+
+// Haversine returns the great-circle distance between two points in kilometers
+func Haversine(lat1, lng1, lat2, lng2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLng := toRad(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// GetCoordinates reads lat, lng and the optional radius in kilometers from the query string
+func GetCoordinates(r *http.Request) (float64, float64, float64, error) {
+	q := r.URL.Query()
+	lat, err := strconv.ParseFloat(q.Get("lat"), 64)
+	if err != nil || !finite(lat) || lat < -90 || lat > 90 {
+		return 0, 0, 0, fmt.Errorf("invalid latitude given %s", q.Get("lat"))
+	}
+	lng, err := strconv.ParseFloat(q.Get("lng"), 64)
+	if err != nil || !finite(lng) || lng < -180 || lng > 180 {
+		return 0, 0, 0, fmt.Errorf("invalid longitude given %s", q.Get("lng"))
+	}
+	radius := defaultRadius
+	if q.Get("radius") != "" {
+		radius, err = strconv.ParseFloat(q.Get("radius"), 64)
+		if err != nil || !finite(radius) || radius <= 0 || radius > maxRadius {
+			return 0, 0, 0, fmt.Errorf("invalid radius given %s", q.Get("radius"))
+		}
+	}
+	return lat, lng, radius, nil
+}
+
+// finite rejects the NaN and Inf that ParseFloat accepts, NaN would slip past every range check
+func finite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
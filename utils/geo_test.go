@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetCoordinatesRejectsNonFinite(t *testing.T) {
+	for _, query := range []string{
+		"lat=NaN&lng=10",
+		"lat=10&lng=nan",
+		"lat=+Inf&lng=10",
+		"lat=10&lng=-Inf",
+		"lat=10&lng=10&radius=NaN",
+		"lat=10&lng=10&radius=Inf",
+	} {
+		r := httptest.NewRequest("GET", "/getNearbyLibraries?"+query, nil)
+		if _, _, _, err := GetCoordinates(r); err == nil {
+			t.Errorf("%s was accepted", query)
+		}
+	}
+	r := httptest.NewRequest("GET", "/getNearbyLibraries?lat=43.2&lng=76.9&radius=5", nil)
+	if _, _, _, err := GetCoordinates(r); err != nil {
+		t.Errorf("valid coordinates refused: %v", err)
+	}
+}
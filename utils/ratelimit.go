@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"Libraria/types"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter takes a token from every bucket in limits, keyed by name, or from none of them when one is empty.
+// It returns how long to wait for the emptiest bucket in that case
+type Limiter interface {
+	Take(limits map[string]types.RateLimit) (time.Duration, error)
+}
+
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("too many requests, try again in %d seconds", retrySeconds(e.RetryAfter))
+}
+
+func TooManyRequests(w http.ResponseWriter, retryAfter time.Duration) error {
+	w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(retryAfter)))
+	return WriteJSON(w, http.StatusTooManyRequests, LibError{Error: (&RateLimitError{retryAfter}).Error()})
+}
+
+func retrySeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+	fullAt    time.Time
+}
+
+// MemoryLimiter keeps buckets in process, it suits a single instance deployment
+type MemoryLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+const memoryLimiterSweep = 10000
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{buckets: map[string]*bucket{}}
+}
+
+func (l *MemoryLimiter) Take(limits map[string]types.RateLimit) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.buckets) > memoryLimiterSweep {
+		l.sweep(now)
+	}
+	var wait time.Duration
+	for key, limit := range limits {
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &bucket{tokens: limit.Burst, updatedAt: now}
+			l.buckets[key] = b
+		}
+		b.tokens = limit.Refill(b.tokens, now.Sub(b.updatedAt))
+		b.updatedAt = now
+		wait = max(wait, limit.Wait(b.tokens))
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+	for key, limit := range limits {
+		b := l.buckets[key]
+		b.tokens--
+		b.fullAt = now.Add(time.Duration((limit.Burst - b.tokens) * float64(limit.Every)))
+	}
+	return 0, nil
+}
+
+// sweep drops buckets that have refilled, they behave exactly like missing ones
+func (l *MemoryLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.After(b.fullAt) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// GetIP returns the client address, X-Forwarded-For is honoured only behind a trusted proxy
+func GetIP(r *http.Request) string {
+	if hops := trustedHops(); hops > 0 {
+		var entries []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, entry := range strings.Split(header, ",") {
+				if entry = strings.TrimSpace(entry); entry != "" {
+					entries = append(entries, entry)
+				}
+			}
+		}
+		// Every proxy appends the address it was reached from, so the client may write anything on the left.
+		// The entry added by the outermost trusted proxy sits hops places from the right
+		if len(entries) > 0 {
+			return entries[max(len(entries)-hops, 0)]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// trustedHops is the number of proxies in front of the server from TRUST_PROXY, "true" stands for one
+func trustedHops() int {
+	value := os.Getenv("TRUST_PROXY")
+	if value == "true" {
+		return 1
+	}
+	hops, err := strconv.Atoi(value)
+	if err != nil || hops < 0 {
+		return 0
+	}
+	return hops
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"Libraria/types"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		trust     string
+		forwarded []string
+		want      string
+	}{
+		{"no proxy ignores the header", "", []string{"1.1.1.1"}, "10.0.0.1"},
+		{"one proxy takes the rightmost entry", "true", []string{"6.6.6.6, 2.2.2.2"}, "2.2.2.2"},
+		{"two proxies skip the inner one", "2", []string{"6.6.6.6, 2.2.2.2, 10.0.0.9"}, "2.2.2.2"},
+		{"repeated headers are one list", "1", []string{"6.6.6.6", "2.2.2.2"}, "2.2.2.2"},
+		{"short list falls back to the first entry", "3", []string{"2.2.2.2, 10.0.0.9"}, "2.2.2.2"},
+		{"missing header uses the peer", "1", nil, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Setenv("TRUST_PROXY", tt.trust)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:4000"
+		for _, header := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		if got := GetIP(r); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryLimiterTakesAllOrNothing(t *testing.T) {
+	limiter := NewMemoryLimiter()
+	ip := types.RateLimit{Burst: 3, Every: time.Hour}
+	email := types.RateLimit{Burst: 1, Every: time.Hour}
+	both := map[string]types.RateLimit{"login:ip:1.1.1.1": ip, "login:email:a@example.com": email}
+
+	if wait, err := limiter.Take(both); err != nil || wait != 0 {
+		t.Fatalf("first request waits %v, %v", wait, err)
+	}
+	for i := 0; i < 5; i++ {
+		if wait, _ := limiter.Take(both); wait == 0 {
+			t.Fatal("the empty email bucket let a request through")
+		}
+	}
+	// the turned away requests left the IP bucket alone
+	for i := 0; i < 2; i++ {
+		if wait, _ := limiter.Take(map[string]types.RateLimit{"login:ip:1.1.1.1": ip}); wait != 0 {
+			t.Fatalf("IP bucket empty after %d requests, rejected ones were charged", i+1)
+		}
+	}
+	if wait, _ := limiter.Take(map[string]types.RateLimit{"login:ip:1.1.1.1": ip}); wait == 0 {
+		t.Error("IP bucket gave more than its burst")
+	}
+}
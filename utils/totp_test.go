@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// the RFC 4226 and RFC 6238 SHA1 test key, "12345678901234567890"
+var rfcKey = []byte("12345678901234567890")
+
+func TestHOTPVectors(t *testing.T) {
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		if got := hotp(rfcKey, int64(counter)); got != code {
+			t.Errorf("counter %d: got %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestTOTPStepVectors(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfcKey)
+	// RFC 6238 appendix B, truncated to six digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		step, ok := TOTPStep(secret, tt.code, time.Unix(tt.unix, 0))
+		if !ok || step != tt.unix/totpPeriod {
+			t.Errorf("%d: got step %d, %v", tt.unix, step, ok)
+		}
+	}
+}
+
+func TestTOTPStepWindow(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	now := time.Unix(1700000000, 0)
+	step := now.Unix() / totpPeriod
+
+	for offset := int64(-totpSkew); offset <= totpSkew; offset++ {
+		got, ok := TOTPStep(secret, hotp(key, step+offset), now)
+		if !ok || got != step+offset {
+			t.Errorf("offset %d: got step %d, %v", offset, got, ok)
+		}
+	}
+	for _, offset := range []int64{-totpSkew - 1, totpSkew + 1} {
+		if _, ok := TOTPStep(secret, hotp(key, step+offset), now); ok {
+			t.Errorf("a code %d steps away was accepted", offset)
+		}
+	}
+
+	code := hotp(key, step)
+	if _, ok := TOTPStep(" "+secret+" ", code[:3]+" "+code[3:], now); !ok {
+		t.Error("spaces in the secret or the code should be ignored")
+	}
+	for _, bad := range []string{"", code[:5], code + "0", "abcdef"} {
+		if _, ok := TOTPStep(secret, bad, now); ok {
+			t.Errorf("code %q was accepted", bad)
+		}
+	}
+	if _, ok := TOTPStep("not base32!", code, now); ok {
+		t.Error("an invalid secret was accepted")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri, err := url.Parse(TOTPURI("Libraria", "reader@example.com", "JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Libraria:reader@example.com" {
+		t.Errorf("unexpected URI %s", uri)
+	}
+	query := uri.Query()
+	for name, want := range map[string]string{"secret": "JBSWY3DPEHPK3PXP", "issuer": "Libraria", "algorithm": "SHA1", "digits": "6", "period": "30"} {
+		if query.Get(name) != want {
+			t.Errorf("%s is %q, want %q", name, query.Get(name), want)
+		}
+	}
+}
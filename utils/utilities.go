@@ -33,3 +33,21 @@ func GetTAG(r *http.Request) string {
 	tag := mux.Vars(r)["tag"]
 	return tag
 }
+
+// ValidTag reports whether tag has the shape of a link token, 64 latin letters and digits
+func ValidTag(tag string) bool {
+	if len(tag) != 64 {
+		return false
+	}
+	for _, c := range tag {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func GetBarcode(r *http.Request) string {
+	barcode := mux.Vars(r)["barcode"]
+	return barcode
+}